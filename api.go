@@ -0,0 +1,505 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/c4pt0r/log"
+)
+
+const (
+	// apiPrefix is the root of the versioned JSON API
+	apiPrefix      = "/_api/v1/"
+	apiNodesPrefix = apiPrefix + "nodes/"
+	apiOpenAPIPath = apiPrefix + "openapi.json"
+
+	scopeRead   = "read"
+	scopeWrite  = "write"
+	scopeDelete = "delete"
+)
+
+// apiToken is a bearer token for the API, limited to scopes and a subtree.
+type apiToken struct {
+	// Name is the commit author of the writes made with the token
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	// Scopes are "read" (GET), "write" (PUT, PATCH) and "delete"
+	Scopes []string `json:"scopes"`
+	// Prefix limits the token to a subtree, e.g. "/blog", default is all
+	Prefix string `json:"prefix"`
+}
+
+// apiConfig is the "api" section of the site config, the API is off
+// without tokens.
+type apiConfig struct {
+	Tokens []apiToken `json:"tokens"`
+}
+
+func (t *apiToken) hasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the token covers the node path, relative to the
+// root with a leading slash.
+func (t *apiToken) allows(nodePath string) bool {
+	prefix := path.Clean("/" + t.Prefix)
+	return prefix == "/" || nodePath == prefix || strings.HasPrefix(nodePath, prefix+"/")
+}
+
+// apiTokenFor returns the token of the request's Authorization header.
+func apiTokenFor(r *http.Request) *apiToken {
+	auth := r.Header.Get("Authorization")
+	bearer, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok || bearer == "" {
+		return nil
+	}
+	tokens := getSiteConfig().API.Tokens
+	for i := range tokens {
+		if subtle.ConstantTimeCompare([]byte(tokens[i].Token), []byte(bearer)) == 1 {
+			return &tokens[i]
+		}
+	}
+	return nil
+}
+
+// apiNode is a node as returned by the API.
+type apiNode struct {
+	Path     string                 `json:"path"`
+	URL      string                 `json:"url"`
+	Title    string                 `json:"title"`
+	Desc     string                 `json:"desc,omitempty"`
+	Date     *time.Time             `json:"date,omitempty"`
+	Modified time.Time              `json:"modified"`
+	IsDir    bool                   `json:"is_dir"`
+	Hidden   bool                   `json:"hidden,omitempty"`
+	Tags     []string               `json:"tags,omitempty"`
+	Conf     map[string]interface{} `json:"conf,omitempty"`
+	Content  *string                `json:"content,omitempty"`
+	Children []apiNode              `json:"children,omitempty"`
+}
+
+// apiPutBody is the JSON body of a PUT, other content types are the raw
+// content.
+type apiPutBody struct {
+	Content string                 `json:"content"`
+	Conf    map[string]interface{} `json:"conf"`
+}
+
+// secretConfFields are left out of the conf returned by the API.
+var secretConfFields = []string{"auth_token", "basic_auth"}
+
+// apiPath returns the node path of an absolute file path, "/" for the root.
+func apiPath(fpath string) string {
+	rel, err := filepath.Rel(_rootDir, fpath)
+	if err != nil || rel == "." {
+		return "/"
+	}
+	return "/" + filepath.ToSlash(rel)
+}
+
+func readConfMap(confFile string) (map[string]interface{}, error) {
+	data, err := readOptional(confFile)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// encodeConfMap validates a .conf.json and returns its content, nil for an
+// empty one.
+func encodeConfMap(m map[string]interface{}) ([]byte, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	data, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	var cfg nodeConf
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// writeConfData writes a .conf.json encoded by encodeConfMap, an empty one
+// is removed.
+func writeConfData(confFile string, data []byte) error {
+	if data == nil {
+		if err := os.Remove(confFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return writeFileAtomic(confFile, data)
+}
+
+// newAPINode describes n, with its conf and content when full is set.
+func newAPINode(n *node, full bool) (*apiNode, error) {
+	an := &apiNode{
+		Path:     apiPath(n.filepath),
+		URL:      n.href(),
+		Title:    n.title,
+		Desc:     n.desc,
+		Modified: n.lastMod(),
+		IsDir:    n.isDir,
+		Hidden:   n.isHidden,
+		Tags:     n.tags,
+	}
+	if !n.date.IsZero() {
+		an.Date = &n.date
+	}
+	if !full {
+		return an, nil
+	}
+	_, confFile, err := getConfigFileForFile(n.filepath)
+	if err != nil {
+		return nil, err
+	}
+	if an.Conf, err = readConfMap(confFile); err != nil {
+		return nil, err
+	}
+	for _, k := range secretConfFields {
+		delete(an.Conf, k)
+	}
+	if f := n.contentFile(); f != "" {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		s := string(content)
+		an.Content = &s
+	}
+	if n.isDir {
+		subnodes, err := n.getSubNodes()
+		if err != nil {
+			return nil, err
+		}
+		an.Children = []apiNode{}
+		for _, sub := range subnodes {
+			child, _ := newAPINode(sub, false)
+			an.Children = append(an.Children, *child)
+		}
+	}
+	return an, nil
+}
+
+// nodeETag returns the entity tag of the content and conf of the node at
+// fpath, "" if it doesn't exist.
+func nodeETag(fpath string) (string, error) {
+	if !fileExists(fpath) {
+		return "", nil
+	}
+	n, err := newNodeFromPath(fpath)
+	if err != nil {
+		return "", err
+	}
+	contentFile, confFile, err := n.editFiles()
+	if err != nil {
+		return "", err
+	}
+	content, err := readOptional(contentFile)
+	if err != nil {
+		return "", err
+	}
+	conf, err := readOptional(confFile)
+	if err != nil {
+		return "", err
+	}
+	return editETag(content, conf), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// serveAPI handles /_api/v1/: the OpenAPI document and the nodes.
+func serveAPI(w http.ResponseWriter, r *http.Request) {
+	log.Infof("%s %s %s", r.RemoteAddr, r.Method, r.URL)
+	if len(getSiteConfig().API.Tokens) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Path == apiOpenAPIPath {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		io.WriteString(w, openAPIDoc)
+		return
+	}
+	if r.URL.Path != strings.TrimSuffix(apiNodesPrefix, "/") && !strings.HasPrefix(r.URL.Path, apiNodesPrefix) {
+		apiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(apiNodesPrefix, "/")), "/")
+	token := apiTokenFor(r)
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="crew"`)
+		apiError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+	fpath, err := resolveNodePath(rel)
+	if err != nil {
+		apiError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	scope := scopeRead
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut, http.MethodPatch:
+		scope = scopeWrite
+	case http.MethodDelete:
+		scope = scopeDelete
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, PATCH, DELETE")
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !token.hasScope(scope) || !token.allows(apiPath(fpath)) {
+		apiError(w, http.StatusForbidden, "token not allowed to "+scope+" "+apiPath(fpath))
+		return
+	}
+
+	etag, err := nodeETag(fpath)
+	if err != nil {
+		log.E(err)
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// optimistic concurrency for writes
+	if m := r.Header.Get("If-Match"); m != "" && scope != scopeRead && m != etag && !(m == "*" && etag != "") {
+		apiError(w, http.StatusPreconditionFailed, "node changed")
+		return
+	}
+	if r.Header.Get("If-None-Match") == "*" && scope != scopeRead && etag != "" {
+		apiError(w, http.StatusPreconditionFailed, "node exists")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		apiGet(w, r, fpath, etag)
+	case http.MethodPut:
+		apiPut(w, r, token, fpath, rel, etag == "")
+	case http.MethodPatch:
+		apiPatch(w, r, token, fpath)
+	case http.MethodDelete:
+		apiDelete(w, token, fpath)
+	}
+}
+
+func apiGet(w http.ResponseWriter, r *http.Request, fpath, etag string) {
+	if etag == "" {
+		apiError(w, http.StatusNotFound, "no such node")
+		return
+	}
+	n, err := newNodeFromPath(fpath)
+	if err != nil {
+		log.E(err)
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	an, err := newAPINode(n, true)
+	if err != nil {
+		log.E(err)
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("ETag", etag)
+	if match := r.Header.Get("If-None-Match"); match == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, http.StatusOK, an)
+}
+
+// apiPut creates or replaces a node: a directory for paths ending with a
+// slash, else a file with the body as content, or the content and conf of
+// a JSON body.
+func apiPut(w http.ResponseWriter, r *http.Request, token *apiToken, fpath, rel string, created bool) {
+	var body apiPutBody
+	isDir := strings.HasSuffix(rel, "/") || rel == ""
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEditSize))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if mediaType == "application/json" {
+		if err := json.Unmarshal(data, &body); err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else {
+		body.Content = string(data)
+	}
+
+	// everything is checked before anything is written
+	if info, err := os.Stat(fpath); err == nil && info.IsDir() != isDir {
+		apiError(w, http.StatusConflict, "is a directory or a file")
+		return
+	}
+	confFile := fpath + ".conf.json"
+	if isDir {
+		confFile = filepath.Join(fpath, ".conf.json")
+	}
+	var confData []byte
+	if body.Conf != nil {
+		if confData, err = encodeConfMap(body.Conf); err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	var files []string
+	if isDir {
+		if err := os.MkdirAll(fpath, 0755); err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if body.Content != "" {
+			index := filepath.Join(fpath, "index.md")
+			if err := writeNodeFile(index, []byte(body.Content)); err != nil {
+				apiError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			files = append(files, index)
+		}
+	} else {
+		if err := writeNodeFile(fpath, []byte(body.Content)); err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		files = append(files, fpath)
+	}
+	if body.Conf != nil {
+		if err := writeConfData(confFile, confData); err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		files = append(files, confFile)
+	}
+	if err := commitFiles(token.Name, "Update "+apiPath(fpath), files...); err != nil {
+		log.E(err)
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	apiRespond(w, fpath, status)
+}
+
+// apiPatch merges a JSON object into the node's .conf.json, null removes
+// a field.
+func apiPatch(w http.ResponseWriter, r *http.Request, token *apiToken, fpath string) {
+	if !fileExists(fpath) {
+		apiError(w, http.StatusNotFound, "no such node")
+		return
+	}
+	var patch map[string]interface{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEditSize)).Decode(&patch); err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	_, confFile, err := getConfigFileForFile(fpath)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	conf, err := readConfMap(confFile)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if conf == nil {
+		conf = make(map[string]interface{})
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(conf, k)
+		} else {
+			conf[k] = v
+		}
+	}
+	data, err := encodeConfMap(conf)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := writeConfData(confFile, data); err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := commitFiles(token.Name, "Update "+apiPath(fpath)+" conf", confFile); err != nil {
+		log.E(err)
+	}
+	apiRespond(w, fpath, http.StatusOK)
+}
+
+func apiDelete(w http.ResponseWriter, token *apiToken, fpath string) {
+	if fpath == filepath.Clean(_rootDir) {
+		apiError(w, http.StatusForbidden, "cannot remove the root")
+		return
+	}
+	removed, err := removeNodeFile(fpath)
+	if len(removed) > 0 {
+		if err := commitFiles(token.Name, "Remove "+apiPath(fpath), removed...); err != nil {
+			log.E(err)
+		}
+	}
+	switch {
+	case os.IsNotExist(err):
+		apiError(w, http.StatusNotFound, "no such node")
+	case errors.Is(err, errDirNotEmpty):
+		apiError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		apiError(w, http.StatusInternalServerError, err.Error())
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// apiRespond writes the node after a write, with its new ETag.
+func apiRespond(w http.ResponseWriter, fpath string, status int) {
+	n, err := newNodeFromPath(fpath)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	an, err := newAPINode(n, true)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if etag, err := nodeETag(fpath); err == nil {
+		w.Header().Set("ETag", etag)
+	}
+	writeJSON(w, status, an)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestSite serves a new root directory with files, paths relative to
+// the root, and cfg, until the end of the test.
+func newTestSite(t *testing.T, cfg *siteConfig, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		fpath := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fpath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldDir, oldCfg, oldRoot, oldIdx := _rootDir, _siteConfig.Load(), _rootNode.Load(), _siteIndex.Load()
+	t.Cleanup(func() {
+		_rootDir = oldDir
+		_siteConfig.Store(oldCfg)
+		_rootNode.Store(oldRoot)
+		_siteIndex.Store(oldIdx)
+	})
+	cfg.RootDir = root
+	_rootDir = root
+	_siteConfig.Store(cfg)
+	rootNode, err := newNodeFromPath(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_rootNode.Store(rootNode)
+	rebuildSiteIndex()
+	return root
+}
+
+func TestAPI(t *testing.T) {
+	files := map[string]string{
+		"a.md":                   "# A\n",
+		"blog/post.md":           "# Post\n",
+		"dir/sub/x.md":           "# X\n",
+		"blog/post.md.conf.json": `{"title": "Post"}` + "\n",
+	}
+	const (
+		all    = "t-all"
+		reader = "t-read"
+	)
+	exists := func(name string) func(t *testing.T, root string) {
+		return func(t *testing.T, root string) {
+			if !fileExists(filepath.Join(root, name)) {
+				t.Errorf("%s doesn't exist", name)
+			}
+		}
+	}
+	missing := func(name string) func(t *testing.T, root string) {
+		return func(t *testing.T, root string) {
+			if fileExists(filepath.Join(root, name)) {
+				t.Errorf("%s exists", name)
+			}
+		}
+	}
+	content := func(name, want string) func(t *testing.T, root string) {
+		return func(t *testing.T, root string) {
+			got, err := os.ReadFile(filepath.Join(root, name))
+			if err != nil || string(got) != want {
+				t.Errorf("%s: got %q (%v), want %q", name, got, err, want)
+			}
+		}
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		header map[string]string
+		body   string
+		want   int
+		check  func(t *testing.T, root string)
+	}{
+		{name: "no token", method: "GET", path: "a.md", want: http.StatusUnauthorized},
+		{name: "unknown token", method: "GET", path: "a.md", token: "nope", want: http.StatusUnauthorized},
+		{name: "get", method: "GET", path: "a.md", token: all, want: http.StatusOK},
+		{name: "get missing", method: "GET", path: "b.md", token: all, want: http.StatusNotFound},
+		{name: "read scope can't write", method: "PUT", path: "blog/post.md", token: reader, body: "x",
+			want: http.StatusForbidden, check: content("blog/post.md", "# Post\n")},
+		{name: "read scope can't delete", method: "DELETE", path: "blog/post.md", token: reader,
+			want: http.StatusForbidden, check: exists("blog/post.md")},
+		{name: "inside the prefix", method: "GET", path: "blog/post.md", token: reader, want: http.StatusOK},
+		{name: "outside the prefix", method: "GET", path: "a.md", token: reader, want: http.StatusForbidden},
+		{name: "prefix is a path, not a string prefix", method: "GET", path: "blogger.md", token: reader, want: http.StatusForbidden},
+		{name: "site config", method: "GET", path: siteConfigName, token: all, want: http.StatusForbidden},
+		{name: "conf file", method: "PUT", path: "a.md.conf.json", token: all, body: "{}",
+			want: http.StatusForbidden, check: missing("a.md.conf.json")},
+		{name: "dot file", method: "PUT", path: ".git/config", token: all, body: "x",
+			want: http.StatusForbidden, check: missing(".git")},
+		{name: "create", method: "PUT", path: "new/b.md", token: all, body: "# B\n",
+			want: http.StatusCreated, check: content("new/b.md", "# B\n")},
+		{name: "replace", method: "PUT", path: "a.md", token: all, body: "# A2\n",
+			want: http.StatusOK, check: content("a.md", "# A2\n")},
+		{name: "create with conf", method: "PUT", path: "c.md", token: all,
+			header: map[string]string{"Content-Type": "application/json"},
+			body:   `{"content": "# C\n", "conf": {"tags": ["x"]}}`,
+			want:   http.StatusCreated, check: exists("c.md.conf.json")},
+		{name: "invalid conf writes nothing", method: "PUT", path: "a.md", token: all,
+			header: map[string]string{"Content-Type": "application/json"},
+			body:   `{"content": "# changed\n", "conf": {"date": "someday"}}`,
+			want:   http.StatusBadRequest, check: content("a.md", "# A\n")},
+		{name: "create directory", method: "PUT", path: "d/", token: all, body: "# D\n",
+			want: http.StatusCreated, check: content("d/index.md", "# D\n")},
+		{name: "file over directory", method: "PUT", path: "dir", token: all, body: "x",
+			want: http.StatusConflict, check: exists("dir/sub/x.md")},
+		{name: "stale If-Match", method: "PUT", path: "a.md", token: all, body: "x",
+			header: map[string]string{"If-Match": `"stale"`},
+			want:   http.StatusPreconditionFailed, check: content("a.md", "# A\n")},
+		{name: "If-Match any", method: "PUT", path: "a.md", token: all, body: "x",
+			header: map[string]string{"If-Match": "*"},
+			want:   http.StatusOK, check: content("a.md", "x")},
+		{name: "If-None-Match any on an existing node", method: "PUT", path: "a.md", token: all, body: "x",
+			header: map[string]string{"If-None-Match": "*"},
+			want:   http.StatusPreconditionFailed, check: content("a.md", "# A\n")},
+		{name: "patch conf", method: "PATCH", path: "blog/post.md", token: all, body: `{"title": null, "desc": "d"}`,
+			want: http.StatusOK, check: content("blog/post.md.conf.json", "{\n    \"desc\": \"d\"\n}\n")},
+		{name: "invalid patch", method: "PATCH", path: "blog/post.md", token: all, body: `{"mode": "nope"}`,
+			want: http.StatusBadRequest, check: content("blog/post.md.conf.json", `{"title": "Post"}`+"\n")},
+		{name: "delete", method: "DELETE", path: "blog/post.md", token: all,
+			want: http.StatusNoContent, check: missing("blog/post.md.conf.json")},
+		{name: "delete missing", method: "DELETE", path: "b.md", token: all, want: http.StatusNotFound},
+		{name: "delete non-empty directory", method: "DELETE", path: "dir", token: all,
+			want: http.StatusConflict, check: exists("dir/sub/x.md")},
+		{name: "delete the root", method: "DELETE", path: "", token: all, want: http.StatusForbidden},
+		{name: "method not allowed", method: "POST", path: "a.md", token: all, want: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultSiteConfig()
+			cfg.API.Tokens = []apiToken{
+				{Name: "ci", Token: all, Scopes: []string{scopeRead, scopeWrite, scopeDelete}},
+				{Name: "bot", Token: reader, Scopes: []string{scopeRead}, Prefix: "/blog"},
+			}
+			root := newTestSite(t, cfg, files)
+			r := httptest.NewRequest(tt.method, apiNodesPrefix+tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			serveAPI(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.check != nil {
+				tt.check(t, root)
+			}
+		})
+	}
+}
+
+func TestAPIDisabledWithoutTokens(t *testing.T) {
+	newTestSite(t, defaultSiteConfig(), map[string]string{"a.md": "# A\n"})
+	w := httptest.NewRecorder()
+	serveAPI(w, httptest.NewRequest("GET", apiNodesPrefix+"a.md", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/c4pt0r/log"
+	"github.com/gomarkdown/markdown/ast"
+)
+
+const (
+	modeBlog = "blog"
+	// moreMarker ends the excerpt of a post on the blog index
+	moreMarker = "<!--more-->"
+
+	defaultPerPage = 10
+	postDateFormat = "January 2, 2006"
+)
+
+func validateMode(mode string) error {
+	switch mode {
+	case "", modeBlog:
+		return nil
+	}
+	return fmt.Errorf("unknown mode: %s", mode)
+}
+
+var datePrefixRe = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})-`)
+
+// splitDatePrefix splits "2006-01-02-title" into the date and "title".
+func splitDatePrefix(name string) (time.Time, string, bool) {
+	m := datePrefixRe.FindStringSubmatch(name)
+	if m == nil {
+		return time.Time{}, name, false
+	}
+	date, err := time.ParseInLocation("2006-01-02", m[1], time.Local)
+	if err != nil {
+		return time.Time{}, name, false
+	}
+	return date, name[len(m[0]):], true
+}
+
+// isBlog reports whether the directory renders its children as posts.
+func (n *node) isBlog() bool {
+	return n.isDir && n.mode == modeBlog
+}
+
+// posts returns the children of a blog directory, newest first unless
+// ordered otherwise.
+func (n *node) posts() ([]*node, error) {
+	subnodes, err := n.getSubNodes()
+	if err != nil {
+		return nil, err
+	}
+	return filterNode(subnodes, func(p *node) bool {
+		return !p.isDir && !p.isHidden && getSiteIndex().isVisible(p) && p.ext() != ".lua"
+	}), nil
+}
+
+// excerpt returns the rendered post up to the <!--more--> marker, or its
+// first paragraph, and whether anything was cut.
+func (n *node) excerpt(ctx context.Context) (string, bool) {
+	// don't let the post fill in the TOC of the index page
+	ctx = context.WithValue(ctx, "page", nil)
+	if _, ok := n.renderer().(markdownRenderer); ok {
+		excerpt, more, err := n.markdownExcerpt(ctx)
+		if err != nil {
+			log.E(err)
+			return "", false
+		}
+		return excerpt, more
+	}
+	content, err := n.Render(ctx)
+	if err != nil {
+		log.E(err)
+		return "", false
+	}
+	if i := bytes.Index(content, []byte(moreMarker)); i >= 0 {
+		return string(content[:i]), true
+	}
+	if i := bytes.Index(content, []byte("</p>")); i >= 0 {
+		end := i + len("</p>")
+		return string(content[:end]), len(bytes.TrimSpace(content[end:])) > 0
+	}
+	return string(content), false
+}
+
+// markdownExcerpt cuts a markdown post before rendering it, so that the
+// excerpt is well-formed: the source up to the <!--more--> marker, or the
+// blocks up to the first paragraph.
+func (n *node) markdownExcerpt(ctx context.Context) (string, bool, error) {
+	content, err := os.ReadFile(n.filepath)
+	if err != nil {
+		return "", false, err
+	}
+	// the body is a suffix of content, keep the front matter in the cut
+	body := stripFrontMatter(content)
+	i := bytes.Index(body, []byte(moreMarker))
+	if i >= 0 {
+		content = content[:len(content)-len(body)+i]
+	}
+	doc, opts, err := n.parseMarkdown(content)
+	if err != nil {
+		return "", false, err
+	}
+	more := i >= 0
+	if !more {
+		blocks := doc.GetChildren()
+		for i, b := range blocks {
+			if _, ok := b.(*ast.Paragraph); ok {
+				more = i < len(blocks)-1
+				doc.SetChildren(blocks[:i+1])
+				break
+			}
+		}
+	}
+	return string(n.renderMarkdownDoc(ctx, doc, opts)), more, nil
+}
+
+// writePosts writes the title, date and excerpt of every post.
+func writePosts(ctx context.Context, buf *bytes.Buffer, posts []*node) {
+	for _, p := range posts {
+		buf.WriteString("<section class=\"post\">")
+		buf.WriteString("<h2><a href=\"" + p.href() + "\">" + p.title + "</a></h2>")
+		buf.WriteString("<p class=\"date\">" + p.pubDate().Format(postDateFormat) + "</p>")
+		excerpt, more := p.excerpt(ctx)
+		buf.WriteString(excerpt)
+		if more {
+			buf.WriteString("<p><a href=\"" + p.href() + "\">Read more »</a></p>")
+		}
+		buf.WriteString("</section>")
+	}
+}
+
+// archiveURL returns the URL of the year (month 0) or month archive.
+func (n *node) archiveURL(year, month int) string {
+	u := n.href() + strconv.Itoa(year) + "/"
+	if month > 0 {
+		u += fmt.Sprintf("%02d/", month)
+	}
+	return u
+}
+
+// writeArchives lists the years and months with posts.
+func writeArchives(buf *bytes.Buffer, dir *node, posts []*node) {
+	type period struct{ year, month int }
+	counts := make(map[period]int)
+	var periods []period
+	for _, p := range posts {
+		d := p.pubDate()
+		for _, k := range []period{{d.Year(), 0}, {d.Year(), int(d.Month())}} {
+			if counts[k] == 0 {
+				periods = append(periods, k)
+			}
+			counts[k]++
+		}
+	}
+	if len(periods) == 0 {
+		return
+	}
+	// newest first, a year before its months
+	sort.Slice(periods, func(i, j int) bool {
+		a, b := periods[i], periods[j]
+		if a.year != b.year {
+			return a.year > b.year
+		}
+		if (a.month == 0) != (b.month == 0) {
+			return a.month == 0
+		}
+		return a.month > b.month
+	})
+	buf.WriteString("<section class=\"archives\"><h4>Archives</h4><ul>")
+	open := false
+	for _, k := range periods {
+		if k.month == 0 {
+			if open {
+				buf.WriteString("</ul></li>")
+			}
+			buf.WriteString(fmt.Sprintf("<li><a href=\"%s\">%d</a> (%d)<ul>", dir.archiveURL(k.year, 0), k.year, counts[k]))
+			open = true
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("<li><a href=\"%s\">%s</a> (%d)</li>",
+			dir.archiveURL(k.year, k.month), time.Month(k.month), counts[k]))
+	}
+	buf.WriteString("</ul></li></ul></section>")
+}
+
+// pageNumber returns the ?page= of the request, starting at 1.
+func pageNumber(ctx context.Context) int {
+	r, ok := ctx.Value("request").(*http.Request)
+	if !ok {
+		return 1
+	}
+	num, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || num < 1 {
+		return 1
+	}
+	return num
+}
+
+// renderBlog renders a page of the blog index, the directory's index page
+// if any goes on top.
+func (n *node) renderBlog(ctx context.Context) ([]byte, error) {
+	var buf bytes.Buffer
+	if indexNode, err := getIndexNodeForDir(n.filepath); err == nil && indexNode != nil {
+		content, err := indexNode.Render(ctx)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(content)
+	} else {
+		buf.WriteString("<h1>" + n.title + "</h1>")
+	}
+	posts, err := n.posts()
+	if err != nil {
+		return nil, err
+	}
+	perPage := n.perPage
+	if perPage <= 0 {
+		perPage = defaultPerPage
+	}
+	pages := (len(posts) + perPage - 1) / perPage
+	num := pageNumber(ctx)
+	if num > pages && pages > 0 {
+		num = pages
+	}
+	start := (num - 1) * perPage
+	end := min(start+perPage, len(posts))
+	writePosts(ctx, &buf, posts[start:end])
+
+	if pages > 1 {
+		buf.WriteString("<nav class=\"pager blog-pager\">")
+		if num > 1 {
+			buf.WriteString(fmt.Sprintf("<a class=\"prev\" href=\"%s?page=%d\">« Newer</a>", n.href(), num-1))
+		}
+		buf.WriteString(fmt.Sprintf("<span>Page %d of %d</span>", num, pages))
+		if num < pages {
+			buf.WriteString(fmt.Sprintf("<a class=\"next\" href=\"%s?page=%d\">Older »</a>", n.href(), num+1))
+		}
+		buf.WriteString("</nav>")
+	}
+	writeArchives(&buf, n, posts)
+	return buf.Bytes(), nil
+}
+
+// parseArchivePath splits .../blog/2006/ or .../blog/2006/01/ into the
+// directory, year and month (0 for a year archive).
+func parseArchivePath(fpath string) (dir string, year, month int, ok bool) {
+	fpath = filepath.Clean(fpath)
+	base := filepath.Base(fpath)
+	if len(base) == 2 {
+		m, err := strconv.Atoi(base)
+		if err != nil || m < 1 || m > 12 {
+			return "", 0, 0, false
+		}
+		month = m
+		fpath = filepath.Dir(fpath)
+		base = filepath.Base(fpath)
+	}
+	if len(base) != 4 {
+		return "", 0, 0, false
+	}
+	y, err := strconv.Atoi(base)
+	if err != nil {
+		return "", 0, 0, false
+	}
+	return filepath.Dir(fpath), y, month, true
+}
+
+// resolvePageFile returns the file to serve for the URL path, resolved to
+// fpath. When fpath doesn't exist it falls back to adding the "*.md" suffix,
+// which ensures correct functioning of basename mode, then to the year and
+// month archives of a blog directory.
+func resolvePageFile(urlPath, fpath string) (file string, year, month int) {
+	if _, err := os.Stat(fpath); !errors.Is(err, os.ErrNotExist) {
+		return fpath, 0, 0
+	}
+	mdPath := filepath.Join(_rootDir, urlPath+".md")
+	if fileExists(mdPath) {
+		return mdPath, 0, 0
+	}
+	if dir, year, month, ok := parseArchivePath(fpath); ok {
+		if n, err := newNodeFromPath(dir); err == nil && n.isBlog() {
+			return dir, year, month
+		}
+	}
+	return mdPath, 0, 0
+}
+
+// blogArchivePage lists the posts of a blog directory in a year or month.
+func blogArchivePage(dir *node, year, month int) *page {
+	p := pageFromNode(dir)
+	title := strconv.Itoa(year)
+	if month > 0 {
+		title = time.Month(month).String() + " " + title
+	}
+	p.Title = dir.title + ": " + title
+	p.bodyRender = func(p *page, ctx context.Context) ([]byte, error) {
+		posts, err := dir.posts()
+		if err != nil {
+			return nil, err
+		}
+		posts = filterNode(posts, func(n *node) bool {
+			d := n.pubDate()
+			return d.Year() == year && (month == 0 || int(d.Month()) == month)
+		})
+		var buf bytes.Buffer
+		buf.WriteString("<h1><a href=\"" + dir.href() + "\">" + dir.title + "</a>: " + html.EscapeString(title) + "</h1>")
+		if len(posts) == 0 {
+			buf.WriteString("<p>No posts.</p>")
+			return buf.Bytes(), nil
+		}
+		buf.WriteString("<ul class=\"archive\">")
+		for _, n := range posts {
+			buf.WriteString("<li>" + n.pubDate().Format(postDateFormat) + " <a href=\"" + n.href() + "\">" + n.title + "</a> " + n.desc + "</li>")
+		}
+		buf.WriteString("</ul>")
+		return buf.Bytes(), nil
+	}
+	return p
+}
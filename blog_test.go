@@ -0,0 +1,38 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePageFile(t *testing.T) {
+	root := newTestSite(t, defaultSiteConfig(), map[string]string{
+		"blog/.conf.json":    `{"mode": "blog"}`,
+		"blog/post.md":       "# Post\n",
+		"blog/2023/index.md": "# 2023\n",
+		"notes/2024.md":      "# 2024\n",
+		"notblog/page.md":    "# Page\n",
+		"blog/2022.md":       "# 2022 post\n",
+	})
+	for _, tt := range []struct {
+		path, file  string
+		year, month int
+	}{
+		{"blog/post.md", "blog/post.md", 0, 0},
+		{"blog/post", "blog/post.md", 0, 0},
+		{"blog/2024", "blog", 2024, 0},
+		{"blog/2024/03", "blog", 2024, 3},
+		{"blog/2023", "blog/2023", 0, 0},
+		{"blog/2022", "blog/2022.md", 0, 0},
+		// archives are only for blogs, other pages named like years are served
+		{"notes/2024", "notes/2024.md", 0, 0},
+		{"notblog/2021", "notblog/2021.md", 0, 0},
+		{"blog/2024/13", "blog/2024/13.md", 0, 0},
+	} {
+		file, year, month := resolvePageFile(tt.path, filepath.Join(root, filepath.FromSlash(tt.path)))
+		want := filepath.Join(root, filepath.FromSlash(tt.file))
+		if file != want || year != tt.year || month != tt.month {
+			t.Errorf("%s: got %s %d %d, want %s %d %d", tt.path, file, year, month, want, tt.year, tt.month)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gomarkdown/markdown"
+)
+
+// siteConfigName is the name of the site-level config file, it lives in the
+// root directory next to the content and is never listed as a node.
+const siteConfigName = "crew.json"
+
+// envPrefix is prepended to the upper-cased flag name (dashes become
+// underscores) to get the environment variable overriding it, e.g.
+// CREW_SITE_SUBTITLE for -site-subtitle.
+const envPrefix = "CREW_"
+
+type link struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+type meta struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+type cacheConfig struct {
+	// StaticMaxAge is the max-age in seconds sent with files under _static,
+	// 0 means no Cache-Control header
+	StaticMaxAge int `json:"static_max_age"`
+}
+
+type siteUser struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Write allows the user to edit pages and revert them
+	Write bool `json:"write"`
+}
+
+type authConfig struct {
+	// Required protects the whole site with basic auth against Users
+	Required bool       `json:"required"`
+	Realm    string     `json:"realm"`
+	Users    []siteUser `json:"users"`
+}
+
+// siteConfig holds the site-wide settings, it's loaded from crew.json and
+// overridden by environment variables and command line flags.
+type siteConfig struct {
+	RootDir string `json:"root_dir"`
+	Addr    string `json:"addr"`
+	// BaseURL is the absolute URL of the site used in feeds, e.g.
+	// https://example.com, guessed from the request when empty
+	BaseURL      string `json:"base_url"`
+	SiteName     string `json:"sitename"`
+	SiteSubtitle string `json:"site_subtitle"`
+	// PageTpl is the path to a custom page template
+	PageTpl string `json:"page_tpl"`
+	// BasenameMode renders URLs without .md suffix
+	BasenameMode bool `json:"basename_mode"`
+	// Dev shows config and template reload errors on every page
+	Dev bool `json:"dev"`
+
+	// HeaderLinks are rendered in the left part of the head nav
+	HeaderLinks []link `json:"header_links"`
+	// Footer is markdown (so plain HTML works too) rendered in the footer
+	Footer  string `json:"footer"`
+	Favicon string `json:"favicon"`
+	// ExtraCSS and ExtraJS are URLs of stylesheets and scripts added to <head>
+	ExtraCSS []string `json:"extra_css"`
+	ExtraJS  []string `json:"extra_js"`
+	Meta     []meta   `json:"meta"`
+
+	// Markdown is the site-wide markdown setting, a .conf.json can change it for a subtree
+	Markdown *markdownConfig `json:"markdown"`
+	// Renderers maps file extensions to renderers: markdown, html, lua,
+	// text or file
+	Renderers rendererConfig `json:"renderers"`
+	// Highlight sets up server-side highlighting of fenced code blocks
+	Highlight highlightConfig `json:"highlight"`
+
+	// Feed sets up the RSS and Atom feeds of directories
+	Feed feedConfig `json:"feed"`
+
+	Cache   cacheConfig   `json:"cache"`
+	Auth    authConfig    `json:"auth"`
+	History historyConfig `json:"history"`
+	API     apiConfig     `json:"api"`
+	WebDAV  webdavConfig  `json:"webdav"`
+	Gemini  geminiConfig  `json:"gemini"`
+	Gopher  gopherConfig  `json:"gopher"`
+	NineP   ninepConfig   `json:"9p"`
+
+	// footerHTML is the rendered Footer
+	footerHTML string
+}
+
+var (
+	// _siteConfig is swapped on reload, see reload.go
+	_siteConfig atomic.Pointer[siteConfig]
+)
+
+func getSiteConfig() *siteConfig {
+	if cfg := _siteConfig.Load(); cfg != nil {
+		return cfg
+	}
+	return defaultSiteConfig()
+}
+
+func defaultSiteConfig() *siteConfig {
+	return &siteConfig{
+		RootDir:      "./site",
+		Addr:         ":8080",
+		SiteName:     "crew",
+		SiteSubtitle: "Bringing more minimalism and sanity to the web, in a suckless way",
+		HeaderLinks: []link{
+			{"quotes", "http://quotes.cat-v.org"},
+			{"docs", "http://doc.cat-v.org"},
+			{"repo", "http://repo.cat-v.org"},
+			{"golang", "http://go-lang.cat-v.org"},
+			{"sam", "http://sam.cat-v.org"},
+			{"man", "http://man.cat-v.org"},
+			{"acme", "http://acme.cat-v.org"},
+			{"Glenda", "http://glenda.cat-v.org"},
+			{"9times", "http://ninetimes.cat-v.org"},
+			{"harmful", "http://harmful.cat-v.org"},
+			{"9P", "http://9p.cat-v.org/"},
+			{"cat-v.org", "http://cat-v.org"},
+		},
+		Footer:  `<a href="http://crew.0xffff.me">Powered by crew</a>`,
+		Favicon: "/_static/favicon.ico",
+		Highlight: highlightConfig{
+			Style: "monokai",
+		},
+		Auth: authConfig{
+			Realm: "Restricted",
+		},
+	}
+}
+
+// setFlagsFromEnv sets the flags which have a matching environment
+// variable, so that flags given on the command line still win.
+func setFlagsFromEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, ok := os.LookupEnv(name); ok && err == nil {
+			if e := fs.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("%s: %w", name, e)
+			}
+		}
+	})
+	return err
+}
+
+// applyFlags overrides the config with the flags set on the command line
+// (or through the environment).
+func (c *siteConfig) applyFlags(fs *flag.FlagSet) error {
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		v := f.Value.String()
+		switch f.Name {
+		case "rootDir":
+			c.RootDir = v
+		case "addr":
+			c.Addr = v
+		case "sitename":
+			c.SiteName = v
+		case "site-subtitle":
+			c.SiteSubtitle = v
+		case "page-tpl":
+			c.PageTpl = v
+		case "basename-mode":
+			c.BasenameMode, err = strconv.ParseBool(v)
+		case "dev":
+			c.Dev, err = strconv.ParseBool(v)
+		}
+	})
+	return err
+}
+
+// loadSiteConfig builds the effective config: defaults, then the config
+// file (-config, or crew.json in the root directory), then environment
+// variables and flags.
+func loadSiteConfig(fs *flag.FlagSet, cfgFile string) (*siteConfig, error) {
+	cfg := defaultSiteConfig()
+	if err := cfg.applyFlags(fs); err != nil {
+		return nil, err
+	}
+	cfgFile = siteConfigPath(cfgFile, cfg.RootDir)
+	if fileExists(cfgFile) {
+		data, err := os.ReadFile(cfgFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", cfgFile, err)
+		}
+		// flags win over the file
+		if err := cfg.applyFlags(fs); err != nil {
+			return nil, err
+		}
+	}
+	if err := defaultMarkdownOptions().apply(cfg.Markdown); err != nil {
+		return nil, err
+	}
+	if err := cfg.Renderers.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Highlight.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Feed.validate(); err != nil {
+		return nil, err
+	}
+	cfg.footerHTML = inlineMarkdown(cfg.Footer)
+	return cfg, nil
+}
+
+// siteConfigPath returns the config file given with -config, or the
+// default one in the root directory.
+func siteConfigPath(cfgFile, rootDir string) string {
+	if cfgFile != "" {
+		return cfgFile
+	}
+	return filepath.Join(rootDir, siteConfigName)
+}
+
+// String returns the config as JSON with passwords masked.
+func (c *siteConfig) String() string {
+	cp := *c
+	cp.Auth.Users = make([]siteUser, len(c.Auth.Users))
+	for i, u := range c.Auth.Users {
+		cp.Auth.Users[i] = siteUser{Username: u.Username, Password: "******", Write: u.Write}
+	}
+	cp.API.Tokens = make([]apiToken, len(c.API.Tokens))
+	for i, t := range c.API.Tokens {
+		cp.API.Tokens[i] = t
+		cp.API.Tokens[i].Token = "******"
+	}
+	b, _ := json.MarshalIndent(&cp, "", "    ")
+	return string(b)
+}
+
+// inlineMarkdown renders a short markdown snippet, a single paragraph is
+// unwrapped so that it can be placed inline.
+func inlineMarkdown(s string) string {
+	out := strings.TrimSpace(string(markdown.ToHTML([]byte(s), nil, nil)))
+	if strings.HasPrefix(out, "<p>") && strings.HasSuffix(out, "</p>") &&
+		strings.Count(out, "<p>") == 1 {
+		out = strings.TrimSuffix(strings.TrimPrefix(out, "<p>"), "</p>")
+	}
+	return out
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newConfigFlags returns a flag set with the config flags parsed from the
+// environment, then args.
+func newConfigFlags(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	fs := flag.NewFlagSet("crew", flag.ContinueOnError)
+	registerConfigFlags(fs)
+	if err := setFlagsFromEnv(fs); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestLoadSiteConfigPrecedence(t *testing.T) {
+	root := t.TempDir()
+	cfgFile := filepath.Join(root, siteConfigName)
+	if err := os.WriteFile(cfgFile, []byte(`{"sitename": "file", "site_subtitle": "file", "addr": ":1"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want siteConfig
+	}{
+		{
+			name: "file over defaults",
+			want: siteConfig{SiteName: "file", SiteSubtitle: "file", Addr: ":1"},
+		},
+		{
+			name: "environment over file",
+			env:  map[string]string{"CREW_SITENAME": "env", "CREW_ADDR": ":2"},
+			want: siteConfig{SiteName: "env", SiteSubtitle: "file", Addr: ":2"},
+		},
+		{
+			name: "flags over environment",
+			env:  map[string]string{"CREW_SITENAME": "env", "CREW_ADDR": ":2"},
+			args: []string{"-addr", ":3", "-site-subtitle", "flag"},
+			want: siteConfig{SiteName: "env", SiteSubtitle: "flag", Addr: ":3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := loadSiteConfig(newConfigFlags(t, append([]string{"-rootDir", root}, tt.args...)...), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.SiteName != tt.want.SiteName || cfg.SiteSubtitle != tt.want.SiteSubtitle || cfg.Addr != tt.want.Addr {
+				t.Errorf("got sitename %q, subtitle %q, addr %q, want %q, %q, %q",
+					cfg.SiteName, cfg.SiteSubtitle, cfg.Addr, tt.want.SiteName, tt.want.SiteSubtitle, tt.want.Addr)
+			}
+			if cfg.RootDir != root {
+				t.Errorf("root dir %q, want %q", cfg.RootDir, root)
+			}
+			// untouched fields keep the default
+			if def := defaultSiteConfig(); cfg.Favicon != def.Favicon || cfg.Highlight.Style != def.Highlight.Style {
+				t.Errorf("defaults lost: favicon %q, style %q", cfg.Favicon, cfg.Highlight.Style)
+			}
+		})
+	}
+}
+
+func TestLoadSiteConfigDefaults(t *testing.T) {
+	cfg, err := loadSiteConfig(newConfigFlags(t, "-rootDir", t.TempDir()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := defaultSiteConfig()
+	if cfg.SiteName != def.SiteName || cfg.Addr != def.Addr {
+		t.Errorf("got %q %q, want the defaults %q %q", cfg.SiteName, cfg.Addr, def.SiteName, def.Addr)
+	}
+}
+
+func TestLoadSiteConfigExplicitFile(t *testing.T) {
+	cfgFile := filepath.Join(t.TempDir(), "site.json")
+	if err := os.WriteFile(cfgFile, []byte(`{"sitename": "elsewhere"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadSiteConfig(newConfigFlags(t, "-rootDir", t.TempDir()), cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SiteName != "elsewhere" {
+		t.Errorf("sitename %q, want the one of -config", cfg.SiteName)
+	}
+}
+
+func TestSiteConfigStringMasksSecrets(t *testing.T) {
+	cfg := defaultSiteConfig()
+	cfg.Auth.Users = []siteUser{{Username: "bob", Password: "hunter2", Write: true}}
+	cfg.API.Tokens = []apiToken{{Name: "ci", Token: "s3cr3t-token", Scopes: []string{"read"}}}
+	s := cfg.String()
+	for _, secret := range []string{"hunter2", "s3cr3t-token"} {
+		if strings.Contains(s, secret) {
+			t.Errorf("String() leaks %q:\n%s", secret, s)
+		}
+	}
+	for _, kept := range []string{`"bob"`, `"ci"`, `"write": true`} {
+		if !strings.Contains(s, kept) {
+			t.Errorf("String() lost %s:\n%s", kept, s)
+		}
+	}
+	// the config itself is untouched
+	if cfg.Auth.Users[0].Password != "hunter2" || cfg.API.Tokens[0].Token != "s3cr3t-token" {
+		t.Error("String() changed the config")
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/c4pt0r/log"
+)
+
+// maxEditSize is the max size of a page saved with the editor.
+const maxEditSize = 10 << 20
+
+// editableConfFields are the .conf.json fields shown in the editor, the
+// others are kept as they are.
+var editableConfFields = []struct {
+	key, label, kind string
+}{
+	{"title", "Title", "text"},
+	{"desc", "Description", "text"},
+	{"date", "Date", "text"},
+	{"tags", "Tags", "list"},
+	{"weight", "Weight", "number"},
+	{"hidden", "Hidden", "bool"},
+	{"toc", "Table of contents", "bool"},
+}
+
+// isEditRequest reports whether the request is for the editor of a node,
+// ?edit, or the preview of a draft, POST ?preview.
+func isEditRequest(r *http.Request) bool {
+	q := r.URL.Query()
+	return q.Has("edit") || q.Has("preview")
+}
+
+// writeUser returns the name of the site user with write permission the
+// request is authenticated as.
+func writeUser(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	for _, u := range getSiteConfig().Auth.Users {
+		if u.Write && checkBasicAuth(auth, u.Username, u.Password) {
+			return u.Username, true
+		}
+	}
+	return "", false
+}
+
+// _csrfKey signs the CSRF tokens of the write forms, it changes on every
+// start.
+var _csrfKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// csrfToken returns the token the forms shown to user send back, the
+// browser sends basic auth credentials with any request so they aren't
+// enough to tell a form of this site from one of another.
+func csrfToken(user string) string {
+	mac := hmac.New(sha256.New, _csrfKey)
+	mac.Write([]byte(user))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkCSRF writes the 403 response and returns false unless the request
+// has the CSRF token of user, in the X-CSRF-Token header or the csrf form
+// field.
+func checkCSRF(w http.ResponseWriter, r *http.Request, user string) bool {
+	token := r.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = r.PostFormValue("csrf")
+	}
+	if !hmac.Equal([]byte(token), []byte(csrfToken(user))) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// checkWrite writes the 401 response and returns false unless the request
+// comes from a user with write permission, from a page of this site.
+func checkWrite(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if origin := r.Header.Get("Origin"); origin != "" && r.Method != http.MethodGet {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return "", false
+		}
+	}
+	user, ok := writeUser(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", getSiteConfig().Auth.Realm))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	return user, true
+}
+
+// editFiles returns the content and .conf.json files of a node, the
+// content of a directory is its index page, index.md if it has none yet.
+func (n *node) editFiles() (content, conf string, err error) {
+	content = n.contentFile()
+	if content == "" && n.isDir {
+		content = filepath.Join(n.filepath, "index.md")
+	}
+	_, conf, err = getConfigFileForFile(n.filepath)
+	return content, conf, err
+}
+
+// isEditable reports whether the node is a markdown or HTML page.
+func (n *node) isEditable() bool {
+	content, _, err := n.editFiles()
+	if err != nil {
+		return false
+	}
+	ext := filepath.Ext(content)
+	return ext == ".md" || ext == ".html"
+}
+
+// readOptional returns the content of the file, nothing if it doesn't exist.
+func readOptional(fpath string) ([]byte, error) {
+	data, err := os.ReadFile(fpath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// editETag returns the entity tag of the content and conf of a node, it
+// changes whenever either of them does.
+func editETag(content, conf []byte) string {
+	h := sha256.New()
+	h.Write(content)
+	h.Write([]byte{0})
+	h.Write(conf)
+	return `"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`
+}
+
+// editPage handles ?edit (GET shows the editor, POST saves) and POST
+// ?preview for a node. It returns nil when it already wrote the response.
+func editPage(w http.ResponseWriter, r *http.Request, n *node) *page {
+	if !n.isEditable() {
+		http.NotFound(w, r)
+		return nil
+	}
+	user, ok := checkWrite(w, r)
+	if !ok {
+		return nil
+	}
+	contentFile, confFile, err := n.editFiles()
+	if err != nil {
+		log.E(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return nil
+	}
+	content, err := readOptional(contentFile)
+	if err != nil {
+		log.E(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return nil
+	}
+	conf, err := readOptional(confFile)
+	if err != nil {
+		log.E(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return nil
+	}
+	etag := editETag(content, conf)
+
+	if r.URL.Query().Has("preview") {
+		if r.Method == http.MethodPost && !checkCSRF(w, r, user) {
+			return nil
+		}
+		servePreview(w, r, n, contentFile)
+		return nil
+	}
+	if r.Method == http.MethodGet {
+		w.Header().Set("ETag", etag)
+		return editorPage(n, string(content), conf, etag, csrfToken(user), "")
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxEditSize)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if !checkCSRF(w, r, user) {
+		return nil
+	}
+	newContent := strings.ReplaceAll(r.PostForm.Get("content"), "\r\n", "\n")
+	newConf, err := updateConf(conf, r.PostForm)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	// optimistic concurrency: the page must not have changed since the
+	// editor was loaded
+	match := r.Header.Get("If-Match")
+	if match == "" {
+		match = r.PostForm.Get("etag")
+	}
+	if match != etag {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusConflict)
+		return editorPage(n, newContent, newConf, etag, csrfToken(user),
+			"This page was changed since you started editing it. Your version is below, saving it will overwrite the other changes.")
+	}
+
+	var files []string
+	if !bytes.Equal(conf, newConf) {
+		if err := writeConfData(confFile, newConf); err != nil {
+			log.E(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return nil
+		}
+		files = append(files, confFile)
+	}
+	if err := saveEdit(user, contentFile, []byte(newContent), files...); err != nil {
+		log.E(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return nil
+	}
+	http.Redirect(w, r, n.href(), http.StatusSeeOther)
+	return nil
+}
+
+// saveEdit writes the content file of a page edited by user and commits it
+// along with the other changed files.
+func saveEdit(user, contentFile string, content []byte, files ...string) error {
+	if err := writeNodeFile(contentFile, content); err != nil {
+		return err
+	}
+	rel, _ := filepath.Rel(_rootDir, contentFile)
+	if err := commitFiles(user, "Edit "+filepath.ToSlash(rel), append([]string{contentFile}, files...)...); err != nil {
+		log.E(err)
+	}
+	return nil
+}
+
+// updateConf sets the editable fields of a .conf.json from the form,
+// empty fields are removed. The other fields are kept. The result is
+// validated like the API's, nil when the conf is left empty.
+func updateConf(conf []byte, form url.Values) ([]byte, error) {
+	m := make(map[string]interface{})
+	if len(bytes.TrimSpace(conf)) > 0 {
+		if err := json.Unmarshal(conf, &m); err != nil {
+			return nil, fmt.Errorf(".conf.json: %w", err)
+		}
+	}
+	for _, f := range editableConfFields {
+		v := strings.TrimSpace(form.Get("conf." + f.key))
+		delete(m, f.key)
+		switch f.kind {
+		case "bool":
+			if v != "" {
+				m[f.key] = true
+			}
+		case "number":
+			if v == "" {
+				continue
+			}
+			num, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", f.key, err)
+			}
+			if num != 0 {
+				m[f.key] = num
+			}
+		case "list":
+			var list []string
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			if len(list) > 0 {
+				m[f.key] = list
+			}
+		default:
+			if v != "" {
+				m[f.key] = v
+			}
+		}
+	}
+	return encodeConfMap(m)
+}
+
+// confFieldValue returns the value of a .conf.json field as shown in the
+// editor.
+func confFieldValue(m map[string]interface{}, key, kind string) string {
+	v, ok := m[key]
+	if !ok {
+		return ""
+	}
+	switch kind {
+	case "list":
+		var items []string
+		if list, ok := v.([]interface{}); ok {
+			for _, item := range list {
+				items = append(items, fmt.Sprint(item))
+			}
+		}
+		return strings.Join(items, ", ")
+	case "bool":
+		if b, ok := v.(bool); ok && b {
+			return "true"
+		}
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// servePreview renders the posted draft as the content of the node.
+func servePreview(w http.ResponseWriter, r *http.Request, n *node, contentFile string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	draft, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEditSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	out := draft
+	if filepath.Ext(contentFile) == ".md" {
+		ctx := context.WithValue(context.Background(), "request", r)
+		if out, err = n.renderMarkdownContent(ctx, draft); err != nil {
+			log.E(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(out)
+}
+
+const editorScript = `<script>
+(function() {
+	var content = document.getElementById("editor-content");
+	var preview = document.getElementById("editor-preview");
+	var csrf = document.querySelector(".editor input[name=csrf]").value;
+	var timer;
+	function update() {
+		fetch("?preview", {method: "POST", body: content.value, credentials: "same-origin", headers: {"X-CSRF-Token": csrf}})
+			.then(function(r) { return r.text(); })
+			.then(function(html) { preview.innerHTML = html; });
+	}
+	content.addEventListener("input", function() {
+		clearTimeout(timer);
+		timer = setTimeout(update, 300);
+	});
+	update();
+})();
+</script>`
+
+// editorPage is the editor of a node with content and conf, msg is shown
+// on top, e.g. for a conflict. csrf is the token of the user, see csrfToken.
+func editorPage(n *node, content string, conf []byte, etag, csrf, msg string) *page {
+	p := pageFromNode(n)
+	p.Title = "Editing " + n.title
+	p.bodyRender = func(p *page, ctx context.Context) ([]byte, error) {
+		m := make(map[string]interface{})
+		if len(bytes.TrimSpace(conf)) > 0 {
+			if err := json.Unmarshal(conf, &m); err != nil {
+				return nil, err
+			}
+		}
+		var buf bytes.Buffer
+		buf.WriteString("<h1>Editing <a href=\"" + n.href() + "\">" + n.title + "</a></h1>")
+		if msg != "" {
+			buf.WriteString("<p class=\"editor-message\">" + html.EscapeString(msg) + "</p>")
+		}
+		buf.WriteString("<form class=\"editor\" method=\"post\" action=\"?edit\">")
+		buf.WriteString("<input type=\"hidden\" name=\"etag\" value=\"" + html.EscapeString(etag) + "\">")
+		buf.WriteString("<input type=\"hidden\" name=\"csrf\" value=\"" + csrf + "\">")
+		buf.WriteString("<fieldset class=\"editor-conf\">")
+		for _, f := range editableConfFields {
+			v := confFieldValue(m, f.key, f.kind)
+			buf.WriteString("<label>" + f.label + " ")
+			switch f.kind {
+			case "bool":
+				checked := ""
+				if v != "" {
+					checked = " checked"
+				}
+				buf.WriteString("<input type=\"checkbox\" name=\"conf." + f.key + "\" value=\"true\"" + checked + ">")
+			case "number":
+				buf.WriteString("<input type=\"number\" name=\"conf." + f.key + "\" value=\"" + html.EscapeString(v) + "\">")
+			default:
+				buf.WriteString("<input type=\"text\" name=\"conf." + f.key + "\" value=\"" + html.EscapeString(v) + "\">")
+			}
+			buf.WriteString("</label> ")
+		}
+		buf.WriteString("</fieldset>")
+		buf.WriteString("<div class=\"editor-split\">")
+		buf.WriteString("<textarea id=\"editor-content\" name=\"content\" rows=\"30\">" + html.EscapeString(content) + "</textarea>")
+		buf.WriteString("<div id=\"editor-preview\"></div>")
+		buf.WriteString("</div>")
+		buf.WriteString("<p><button type=\"submit\">save</button> <a href=\"" + n.href() + "\">cancel</a></p>")
+		buf.WriteString("</form>")
+		buf.WriteString(editorScript)
+		return buf.Bytes(), nil
+	}
+	return p
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEditorSave(t *testing.T) {
+	const conf = `{"title": "A"}` + "\n"
+	for _, tt := range []struct {
+		name        string
+		form        url.Values
+		want        int
+		content     string
+		conf        string
+		confRemoved bool
+	}{
+		{
+			name:    "save",
+			form:    url.Values{"content": {"# B\r\n"}, "conf.title": {"B"}, "conf.tags": {"x, y"}},
+			want:    http.StatusSeeOther,
+			content: "# B\n",
+			conf:    "{\n    \"tags\": [\n        \"x\",\n        \"y\"\n    ],\n    \"title\": \"B\"\n}\n",
+		},
+		{
+			name:    "invalid date writes nothing",
+			form:    url.Values{"content": {"# B\n"}, "conf.title": {"A"}, "conf.date": {"someday"}},
+			want:    http.StatusBadRequest,
+			content: "# A\n",
+			conf:    conf,
+		},
+		{
+			name:        "empty conf is removed",
+			form:        url.Values{"content": {"# A\n"}},
+			want:        http.StatusSeeOther,
+			content:     "# A\n",
+			confRemoved: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultSiteConfig()
+			cfg.Auth.Users = []siteUser{{Username: "bob", Password: "pw", Write: true}}
+			root := newTestSite(t, cfg, map[string]string{"a.md": "# A\n", "a.md.conf.json": conf})
+			n := getSiteIndex().lookup(filepath.Join(root, "a.md"))
+			if n == nil {
+				t.Fatal("a.md isn't indexed")
+			}
+
+			get := httptest.NewRequest("GET", "/a.md?edit", nil)
+			get.SetBasicAuth("bob", "pw")
+			w := httptest.NewRecorder()
+			if p := editPage(w, get, n); p == nil {
+				t.Fatalf("editor not shown: %d", w.Code)
+			}
+
+			form := url.Values{"csrf": {csrfToken("bob")}, "etag": {w.Header().Get("ETag")}}
+			for k, v := range tt.form {
+				form[k] = v
+			}
+			r := httptest.NewRequest("POST", "/a.md?edit", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.SetBasicAuth("bob", "pw")
+			w = httptest.NewRecorder()
+			editPage(w, r, n)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			if got, _ := os.ReadFile(filepath.Join(root, "a.md")); string(got) != tt.content {
+				t.Errorf("content %q, want %q", got, tt.content)
+			}
+			got, err := os.ReadFile(filepath.Join(root, "a.md.conf.json"))
+			if tt.confRemoved {
+				if !os.IsNotExist(err) {
+					t.Errorf("conf %q not removed", got)
+				}
+			} else if string(got) != tt.conf {
+				t.Errorf("conf %q, want %q", got, tt.conf)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/c4pt0r/log"
+)
+
+const (
+	rssFeedName  = "feed.xml"
+	atomFeedName = "atom.xml"
+
+	defaultFeedLimit = 20
+)
+
+// feedConfig is the "feed" section of the site config, directories can
+// override Limit and Order in their .conf.json.
+type feedConfig struct {
+	// All gives every directory a feed, otherwise only the ones with
+	// "feed": true in their .conf.json have one
+	All   bool `json:"all"`
+	Limit int  `json:"limit"`
+	// Order is "date" (newest first, the default) or "title"
+	Order string `json:"order"`
+}
+
+func (c *feedConfig) validate() error {
+	return validateFeedOrder(c.Order)
+}
+
+func validateFeedOrder(order string) error {
+	switch order {
+	case "", "date", "title":
+		return nil
+	}
+	return fmt.Errorf("unknown feed order: %s", order)
+}
+
+// pubDate returns the date of the node from front matter or .conf.json,
+// falling back to its modification time.
+func (n *node) pubDate() time.Time {
+	if !n.date.IsZero() {
+		return n.date
+	}
+	return n.modTime
+}
+
+// siteBaseURL returns the absolute URL of the site, from the config or
+// guessed from the request.
+func siteBaseURL(r *http.Request) string {
+	if u := getSiteConfig().BaseURL; u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	Description string `xml:"description"`
+	GUID        string `xml:"guid"`
+	PubDate     string `xml:"pubDate"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Summary string      `xml:"summary,omitempty"`
+	Content atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// feedEntry is a child node of a directory with its rendered content.
+type feedEntry struct {
+	node    *node
+	content string
+}
+
+// hasFeed reports whether the directory serves feeds.
+func (n *node) hasFeed() bool {
+	return n.isDir && (n.feed || getSiteConfig().Feed.All)
+}
+
+// feedEntries returns the visible children of a directory with content,
+// ordered and limited as configured.
+func feedEntries(ctx context.Context, dir *node) ([]feedEntry, error) {
+	subnodes, err := dir.getSubNodes()
+	if err != nil {
+		return nil, err
+	}
+	cfg := getSiteConfig().Feed
+	order, limit := cfg.Order, cfg.Limit
+	if dir.feedOrder != "" {
+		order = dir.feedOrder
+	}
+	if dir.feedLimit > 0 {
+		limit = dir.feedLimit
+	}
+	if limit <= 0 {
+		limit = defaultFeedLimit
+	}
+
+	subnodes = filterNode(subnodes, func(n *node) bool {
+		return !n.isHidden && getSiteIndex().isVisible(n) && n.ext() != ".lua"
+	})
+	switch order {
+	case "title":
+		sort.SliceStable(subnodes, func(i, j int) bool { return subnodes[i].title < subnodes[j].title })
+	default:
+		sort.SliceStable(subnodes, func(i, j int) bool { return subnodes[i].pubDate().After(subnodes[j].pubDate()) })
+	}
+	if len(subnodes) > limit {
+		subnodes = subnodes[:limit]
+	}
+
+	var entries []feedEntry
+	for _, n := range subnodes {
+		e := feedEntry{node: n}
+		if n.isDir || n.ext() == ".md" || n.ext() == ".html" {
+			content, err := n.Render(ctx)
+			if err != nil {
+				// e.g. a directory without index, keep the entry without content
+				log.E(err)
+			}
+			e.content = string(content)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// serveFeed writes the RSS (feed.xml) or Atom (atom.xml) feed of a directory.
+func serveFeed(w http.ResponseWriter, r *http.Request, dir *node, name string) {
+	entries, err := feedEntries(r.Context(), dir)
+	if err != nil {
+		log.E(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	base := siteBaseURL(r)
+	title := dir.title
+	if dir.filepath == getRootNode().filepath {
+		title = getSiteConfig().SiteName
+	}
+	updated := dir.modTime
+	for _, e := range entries {
+		if d := e.node.pubDate(); d.After(updated) {
+			updated = d
+		}
+	}
+
+	var v interface{}
+	contentType := "application/rss+xml; charset=utf-8"
+	if name == atomFeedName {
+		contentType = "application/atom+xml; charset=utf-8"
+		feed := atomFeed{
+			Title:   title,
+			ID:      base + dir.href(),
+			Updated: updated.Format(time.RFC3339),
+			Author:  atomAuthor{Name: getSiteConfig().SiteName},
+			Links: []atomLink{
+				{Href: base + dir.href()},
+				{Href: base + dir.href() + atomFeedName, Rel: "self"},
+			},
+		}
+		for _, e := range entries {
+			feed.Entries = append(feed.Entries, atomEntry{
+				Title:   e.node.title,
+				ID:      base + e.node.href(),
+				Updated: e.node.pubDate().Format(time.RFC3339),
+				Link:    atomLink{Href: base + e.node.href()},
+				Summary: e.node.desc,
+				Content: atomContent{Type: "html", Body: e.content},
+			})
+		}
+		v = feed
+	} else {
+		feed := rssFeed{
+			Version: "2.0",
+			Channel: rssChannel{
+				Title:         title,
+				Link:          base + dir.href(),
+				Description:   dir.desc,
+				LastBuildDate: updated.Format(time.RFC1123Z),
+			},
+		}
+		for _, e := range entries {
+			feed.Channel.Items = append(feed.Channel.Items, rssItem{
+				Title:       e.node.title,
+				Link:        base + e.node.href(),
+				Description: e.content,
+				GUID:        base + e.node.href(),
+				PubDate:     e.node.pubDate().Format(time.RFC1123Z),
+			})
+		}
+		v = feed
+	}
+
+	out, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.E(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c4pt0r/log"
+)
+
+// frontMatterDelim opens and closes the front matter of a markdown file.
+const frontMatterDelim = "---"
+
+// dateLayouts are the accepted formats of the "date" field.
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+func parseDate(s string) (time.Time, error) {
+	for _, layout := range dateLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date: %q", s)
+}
+
+// splitFrontMatter splits a markdown file into its front matter (without
+// the delimiters) and its body. fm is nil when there's no front matter.
+func splitFrontMatter(content []byte) (fm []byte, body []byte) {
+	if !bytes.HasPrefix(content, []byte(frontMatterDelim+"\n")) &&
+		!bytes.HasPrefix(content, []byte(frontMatterDelim+"\r\n")) {
+		return nil, content
+	}
+	rest := content[bytes.IndexByte(content, '\n')+1:]
+	for off := 0; off < len(rest); {
+		end := bytes.IndexByte(rest[off:], '\n')
+		line := rest[off:]
+		if end >= 0 {
+			line = rest[off : off+end]
+		}
+		if string(bytes.TrimRight(line, "\r")) == frontMatterDelim {
+			if end < 0 {
+				return rest[:off], nil
+			}
+			return rest[:off], rest[off+end+1:]
+		}
+		if end < 0 {
+			break
+		}
+		off += end + 1
+	}
+	// not closed, it's not front matter
+	return nil, content
+}
+
+// stripFrontMatter returns the markdown body without front matter. A block
+// that doesn't parse as front matter, like text between two horizontal
+// rules, is part of the body.
+func stripFrontMatter(content []byte) []byte {
+	fm, body := splitFrontMatter(content)
+	if fm == nil {
+		return content
+	}
+	if cfg, err := parseFrontMatter(fm); err != nil || cfg.validate() != nil {
+		return content
+	}
+	return body
+}
+
+// unquote strips matching single or double quotes.
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// nodeConfKinds maps the json keys of nodeConf to the kind of their field,
+// front matter values are converted to it.
+var nodeConfKinds = func() map[string]reflect.Kind {
+	m := make(map[string]reflect.Kind)
+	t := reflect.TypeOf(nodeConf{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		m[name] = t.Field(i).Type.Kind()
+	}
+	return m
+}()
+
+// fmValue converts a front matter value to the JSON value expected by the
+// nodeConf field key: strings, booleans, numbers or [a, b] lists.
+func fmValue(key, s string) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	switch nodeConfKinds[key] {
+	case reflect.Bool:
+		return strconv.ParseBool(s)
+	case reflect.Int, reflect.Int64, reflect.Float64:
+		return strconv.ParseFloat(s, 64)
+	case reflect.Slice:
+		list := []string{}
+		for _, item := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"), ",") {
+			if item = unquote(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list, nil
+	}
+	return unquote(s), nil
+}
+
+// parseFrontMatter reads "key: value" lines into a nodeConf, keys are the
+// same as in .conf.json. Lists are written inline ([a, b]) or as "- item"
+// lines below the key.
+func parseFrontMatter(fm []byte) (*nodeConf, error) {
+	m := make(map[string]interface{})
+	var listKey string
+	for i, line := range strings.Split(string(fm), "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") && listKey != "" {
+			m[listKey] = append(m[listKey].([]string), unquote(trimmed[2:]))
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("front matter line %d: missing ':'", i+2)
+		}
+		key = strings.TrimSpace(key)
+		listKey = ""
+		if kind := nodeConfKinds[key]; strings.TrimSpace(value) == "" &&
+			(kind == reflect.Slice || kind == reflect.Invalid) {
+			// the list is on the next lines, unknown keys are ignored anyway
+			listKey = key
+			m[key] = []string{}
+			continue
+		}
+		v, err := fmValue(key, value)
+		if err != nil {
+			return nil, fmt.Errorf("front matter line %d: %s: %w", i+2, key, err)
+		}
+		m[key] = v
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var cfg nodeConf
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("front matter: %w", err)
+	}
+	return &cfg, nil
+}
+
+// maxFrontMatter bounds how much of a file is read looking for the end of
+// its front matter.
+const maxFrontMatter = 64 << 10
+
+// readFrontMatter returns the front matter of a markdown file, or nil. Only
+// the front matter is read, not the body. Front matter that doesn't parse
+// is logged and ignored, the block is then rendered as part of the body.
+func readFrontMatter(fpath string) (*nodeConf, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(io.LimitReader(f, maxFrontMatter))
+	first, err := r.ReadString('\n')
+	if strings.TrimRight(first, "\r\n") != frontMatterDelim || err != nil {
+		return nil, nil
+	}
+	head := []byte(first)
+	for {
+		line, err := r.ReadString('\n')
+		head = append(head, line...)
+		if strings.TrimRight(line, "\r\n") == frontMatterDelim {
+			break
+		}
+		if err != nil {
+			// not closed, it's not front matter
+			return nil, nil
+		}
+	}
+	fm, _ := splitFrontMatter(head)
+	if fm == nil {
+		return nil, nil
+	}
+	cfg, err := parseFrontMatter(fm)
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err != nil {
+		log.W(fpath, "ignoring front matter:", err)
+		return nil, nil
+	}
+	return cfg, nil
+}
+
+// validate checks the fields that would make the node fail to load, so
+// that a bad header is ignored and a bad write refused instead.
+func (c *nodeConf) validate() error {
+	if c.Date != "" {
+		if _, err := parseDate(c.Date); err != nil {
+			return err
+		}
+	}
+	if c.FeedOrder != "" {
+		if err := validateFeedOrder(c.FeedOrder); err != nil {
+			return err
+		}
+	}
+	if c.Order != "" {
+		if err := validateOrder(c.Order); err != nil {
+			return err
+		}
+	}
+	if c.Layout != "" {
+		if err := validateLayout(c.Layout); err != nil {
+			return err
+		}
+	}
+	if c.Mode != "" {
+		return validateMode(c.Mode)
+	}
+	return nil
+}
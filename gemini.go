@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/c4pt0r/log"
+	"github.com/gomarkdown/markdown/ast"
+)
+
+const (
+	defaultGeminiAddr = ":1965"
+	geminiMIME        = "text/gemini; charset=utf-8"
+	// geminiMethod is the method of the requests given to Lua nodes, their
+	// gemini(request) function answers them
+	geminiMethod = "GEMINI"
+	// geminiTimeout bounds reading the request and writing the response
+	geminiTimeout = 30 * time.Second
+)
+
+// geminiConfig is the "gemini" section of the site config.
+type geminiConfig struct {
+	Enabled bool   `json:"enabled"`
+	Addr    string `json:"addr"`
+	// CertFile and KeyFile are the TLS certificate, without them a self
+	// signed one for Hostname is generated at startup
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	Hostname string `json:"hostname"`
+}
+
+// certificate returns the configured certificate or a self signed one.
+func (c *geminiConfig) certificate() (tls.Certificate, error) {
+	if c.CertFile != "" || c.KeyFile != "" {
+		return tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	}
+	host := c.Hostname
+	if host == "" {
+		host = "localhost"
+	}
+	return selfSignedCert(host)
+}
+
+func selfSignedCert(host string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// geminiServer serves the node tree as gemtext.
+func geminiServer(cfg geminiConfig) error {
+	cert, err := cfg.certificate()
+	if err != nil {
+		return err
+	}
+	addr := cfg.Addr
+	if addr == "" {
+		addr = defaultGeminiAddr
+	}
+	ln, err := tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		return err
+	}
+	log.I("Starting Gemini server on", addr)
+	return serveGemini(ln)
+}
+
+// serveGemini handles the connections of a TLS listener until it's closed.
+func serveGemini(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handleGemini(conn)
+	}
+}
+
+func handleGemini(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(geminiTimeout))
+	// the request is an absolute URL of at most 1024 bytes and CRLF
+	line, err := bufio.NewReaderSize(conn, 1026).ReadSlice('\n')
+	if err != nil || len(line) > 1026 {
+		io.WriteString(conn, "59 Bad request\r\n")
+		return
+	}
+	u, err := url.Parse(strings.TrimRight(string(line), "\r\n"))
+	if err != nil || (u.Scheme != "gemini" && u.Scheme != "") {
+		io.WriteString(conn, "59 Bad request\r\n")
+		return
+	}
+	log.Infof("%s GEMINI %s", conn.RemoteAddr(), u)
+	if getSiteConfig().Auth.Required {
+		io.WriteString(conn, "50 This site requires a login, use the web site\r\n")
+		return
+	}
+	mimeType, body, err := geminiResponse(u)
+	if err != nil {
+		if os.IsNotExist(err) {
+			io.WriteString(conn, "51 Not found\r\n")
+			return
+		}
+		log.E(err)
+		io.WriteString(conn, "40 Temporary failure\r\n")
+		return
+	}
+	fmt.Fprintf(conn, "20 %s\r\n", mimeType)
+	conn.Write(body)
+}
+
+// isPublic reports whether the node can be served without auth, i.e.
+// neither it nor its parents is protected, as the Gemini and Gopher servers
+// have no login. Hidden nodes are reachable, only not listed, like on the
+// web.
+func isPublic(n *node) bool {
+	for cur := n; cur != nil; cur, _ = cur.getParentNode() {
+		if cur.authToken != "" || (cur.basicAuth.username != "" && cur.basicAuth.password != "") {
+			return false
+		}
+	}
+	return true
+}
+
+// geminiResponse returns the MIME type and body for the URL.
+func geminiResponse(u *url.URL) (string, []byte, error) {
+	fpath, err := resolveNodePath(u.Path)
+	if err != nil {
+		return "", nil, os.ErrNotExist
+	}
+	if !fileExists(fpath) && fileExists(fpath+".md") {
+		fpath += ".md"
+	}
+	n, err := newNodeFromPath(fpath)
+	if err != nil {
+		return "", nil, err
+	}
+	if !isPublic(n) {
+		return "", nil, os.ErrNotExist
+	}
+	if n.isDir {
+		return geminiMIME, []byte(geminiDir(n)), nil
+	}
+	switch n.ext() {
+	case ".md":
+		content, err := readNodeMarkdown(n)
+		if err != nil {
+			return "", nil, err
+		}
+		return geminiMIME, []byte(markdownToGemtext(n, content)), nil
+	case ".html":
+		content, err := os.ReadFile(n.filepath)
+		if err != nil {
+			return "", nil, err
+		}
+		return geminiMIME, []byte(htmlToGemtext(string(content))), nil
+	case ".lua":
+		body, err := geminiLua(n, u)
+		return geminiMIME, body, err
+	}
+	content, err := os.ReadFile(n.filepath)
+	if err != nil {
+		return "", nil, err
+	}
+	mimeType := mime.TypeByExtension(n.ext())
+	if mimeType == "" {
+		mimeType = http.DetectContentType(content)
+	}
+	return mimeType, content, nil
+}
+
+// readNodeMarkdown returns the markdown of a file without front matter.
+func readNodeMarkdown(n *node) ([]byte, error) {
+	content, err := os.ReadFile(n.filepath)
+	if err != nil {
+		return nil, err
+	}
+	return stripFrontMatter(content), nil
+}
+
+// geminiDir renders a directory: its index page, then links to its
+// children.
+func geminiDir(n *node) string {
+	var sb strings.Builder
+	if filepath.Clean(n.filepath) == filepath.Clean(_rootDir) {
+		cfg := getSiteConfig()
+		sb.WriteString("# " + cfg.SiteName + "\n")
+		if cfg.SiteSubtitle != "" {
+			sb.WriteString(cfg.SiteSubtitle + "\n")
+		}
+		sb.WriteString("\n")
+	}
+	if idx, err := getIndexNodeForDir(n.filepath); err == nil && idx != nil {
+		if idx.ext() == ".md" {
+			if content, err := readNodeMarkdown(idx); err == nil {
+				sb.WriteString(markdownToGemtext(idx, content))
+			}
+		} else if content, err := os.ReadFile(idx.filepath); err == nil {
+			sb.WriteString(htmlToGemtext(string(content)))
+		}
+	} else {
+		sb.WriteString("# " + n.title + "\n")
+	}
+	subnodes, err := n.getSubNodes()
+	if err != nil {
+		log.E(err)
+	}
+	var links []string
+	for _, sub := range subnodes {
+		if sub.isHidden || !isPublic(sub) {
+			continue
+		}
+		label := sub.title
+		if sub.isDir {
+			label += "/"
+		}
+		if sub.desc != "" {
+			label += " - " + sub.desc
+		}
+		links = append(links, "=> "+sub.href()+" "+label)
+	}
+	if len(links) > 0 {
+		sb.WriteString("\n" + strings.Join(links, "\n") + "\n")
+	}
+	return sb.String()
+}
+
+// gemLink is a link found in a block, gemtext puts links on their own lines.
+type gemLink struct {
+	url, label string
+}
+
+// gemWriter converts a markdown AST to gemtext.
+type gemWriter struct {
+	sb    strings.Builder
+	links []gemLink
+}
+
+// markdownToGemtext converts markdown to gemtext: headings, paragraphs on
+// one line followed by their links, lists, quotes and preformatted blocks.
+func markdownToGemtext(n *node, content []byte) string {
+	p := defaultMarkdownOptions().newParser()
+	registerWikiLinks(p, getSiteIndex(), n, nil)
+	doc := p.Parse(content)
+	g := &gemWriter{}
+	for _, child := range doc.GetChildren() {
+		g.block(child, "")
+	}
+	return strings.TrimLeft(g.sb.String(), "\n")
+}
+
+func (g *gemWriter) flushLinks() {
+	for _, l := range g.links {
+		g.sb.WriteString("=> " + l.url)
+		if l.label != "" && l.label != l.url {
+			g.sb.WriteString(" " + l.label)
+		}
+		g.sb.WriteString("\n")
+	}
+	g.links = nil
+}
+
+// block writes a block node, prefix is "> " in quotes.
+func (g *gemWriter) block(node ast.Node, prefix string) {
+	switch node := node.(type) {
+	case *ast.Heading:
+		level := min(node.Level, 3)
+		g.sb.WriteString("\n" + strings.Repeat("#", level) + " " + g.inline(node) + "\n")
+		g.flushLinks()
+	case *ast.Paragraph:
+		if text := g.inline(node); text != "" {
+			g.sb.WriteString("\n" + prefix + text + "\n")
+		}
+		g.flushLinks()
+	case *ast.List:
+		g.sb.WriteString("\n")
+		g.listItems(node, prefix)
+		g.flushLinks()
+	case *ast.BlockQuote:
+		for _, child := range node.Children {
+			g.block(child, "> ")
+		}
+	case *ast.CodeBlock:
+		g.sb.WriteString("\n```" + string(node.Info) + "\n" + strings.TrimRight(string(node.Literal), "\n") + "\n```\n")
+	case *ast.Table:
+		g.sb.WriteString("\n```\n")
+		ast.WalkFunc(node, func(n ast.Node, entering bool) ast.WalkStatus {
+			if row, ok := n.(*ast.TableRow); ok && entering {
+				var cells []string
+				for _, cell := range row.Children {
+					cells = append(cells, g.inline(cell))
+				}
+				g.sb.WriteString(strings.Join(cells, " | ") + "\n")
+				return ast.SkipChildren
+			}
+			return ast.GoToNext
+		})
+		g.sb.WriteString("```\n")
+		g.flushLinks()
+	case *ast.HTMLBlock:
+		if text := stripTags(string(node.Literal)); text != "" {
+			g.sb.WriteString("\n" + prefix + text + "\n")
+		}
+	case *ast.HorizontalRule:
+		g.sb.WriteString("\n")
+	default:
+		for _, child := range node.GetChildren() {
+			g.block(child, prefix)
+		}
+	}
+}
+
+// listItems writes "* item" lines, nested lists are flattened.
+func (g *gemWriter) listItems(list *ast.List, prefix string) {
+	for _, item := range list.Children {
+		var parts []string
+		var nested []*ast.List
+		for _, child := range item.GetChildren() {
+			if l, ok := child.(*ast.List); ok {
+				nested = append(nested, l)
+				continue
+			}
+			if text := g.inline(child); text != "" {
+				parts = append(parts, text)
+			}
+		}
+		g.sb.WriteString(prefix + "* " + strings.Join(parts, " ") + "\n")
+		for _, l := range nested {
+			g.listItems(l, prefix)
+		}
+	}
+}
+
+// inline returns the text of a node on one line, collecting its links.
+func (g *gemWriter) inline(node ast.Node) string {
+	var sb strings.Builder
+	ast.WalkFunc(node, func(n ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		switch n := n.(type) {
+		case *ast.Text:
+			sb.Write(n.Literal)
+		case *ast.Code:
+			sb.WriteString("`" + string(n.Literal) + "`")
+		case *ast.Softbreak, *ast.Hardbreak:
+			sb.WriteString(" ")
+		case *ast.Link:
+			label := g.children(n)
+			sb.WriteString(label)
+			g.links = append(g.links, gemLink{url: string(n.Destination), label: label})
+			return ast.SkipChildren
+		case *ast.Image:
+			alt := g.children(n)
+			g.links = append(g.links, gemLink{url: string(n.Destination), label: "image: " + alt})
+			sb.WriteString(alt)
+			return ast.SkipChildren
+		}
+		return ast.GoToNext
+	})
+	return strings.Join(strings.Fields(sb.String()), " ")
+}
+
+// children returns the inline text of the children of a link or image.
+func (g *gemWriter) children(node ast.Node) string {
+	var parts []string
+	for _, child := range node.GetChildren() {
+		parts = append(parts, g.inline(child))
+	}
+	return strings.Join(parts, "")
+}
+
+// htmlToGemtext keeps the text of an HTML page, a paragraph per block.
+func htmlToGemtext(s string) string {
+	for _, tag := range []string{"</p>", "<br>", "<br/>", "</h1>", "</h2>", "</h3>", "</li>", "</div>"} {
+		s = strings.ReplaceAll(s, tag, tag+"\x00")
+	}
+	var paras []string
+	for _, part := range strings.Split(s, "\x00") {
+		if text := stripTags(part); text != "" {
+			paras = append(paras, text)
+		}
+	}
+	return strings.Join(paras, "\n\n") + "\n"
+}
+
+// geminiLua answers with the gemini(request) function of a Lua node,
+// request.input is the query of the URL.
+func geminiLua(n *node, u *url.URL) ([]byte, error) {
+	r, err := http.NewRequest(geminiMethod, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := n.renderLua(context.WithValue(context.Background(), "request", r))
+	if errors.Is(err, errNoGeminiFunc) {
+		return nil, os.ErrNotExist
+	}
+	return body, err
+}
+
+// errNoGeminiFunc is returned for Lua nodes without a gemini function.
+var errNoGeminiFunc = errors.New("gemini function not found in lua file")
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"strings"
+	"testing"
+)
+
+// startGemini serves the current site over Gemini on a local port until
+// the end of the test and returns its address.
+func startGemini(t *testing.T) string {
+	t.Helper()
+	cert, err := selfSignedCert("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go serveGemini(ln)
+	return ln.Addr().String()
+}
+
+// geminiGet requests the URL and returns the response header and body.
+func geminiGet(t *testing.T, addr, u string) (string, string) {
+	t.Helper()
+	// Gemini clients trust the certificate on first use
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, u+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	header, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(header, "\r\n"), string(body)
+}
+
+func TestGemini(t *testing.T) {
+	cfg := defaultSiteConfig()
+	cfg.SiteName = "Test site"
+	newTestSite(t, cfg, map[string]string{
+		"page.md":                  "---\ntitle: Page\n---\n# Page\n\nSome *text* with a [link](/docs/a.md).\n\n* one\n* two\n",
+		"docs/a.md":                "# A\n",
+		"docs/b.md":                "# B\n",
+		"private/.conf.json":       `{"basic_auth": {"username": "u", "password": "p"}}`,
+		"private/secret.md":        "# Secret\n",
+		"docs/hidden.md":           "# Hidden\n",
+		"docs/hidden.md.conf.json": `{"hidden": true}`,
+	})
+	addr := startGemini(t)
+
+	tests := []struct {
+		name, url, header, body string
+	}{
+		{
+			name:   "page",
+			url:    "gemini://localhost/page.md",
+			header: "20 text/gemini; charset=utf-8",
+			body:   "# Page\n\nSome text with a link.\n=> /docs/a.md link\n\n* one\n* two\n",
+		},
+		{
+			name:   "directory",
+			url:    "gemini://localhost/docs/",
+			header: "20 text/gemini; charset=utf-8",
+			body:   "# docs\n\n=> /docs/a.md a\n=> /docs/b.md b\n",
+		},
+		{
+			name:   "page without extension",
+			url:    "gemini://localhost/docs/a",
+			header: "20 text/gemini; charset=utf-8",
+			body:   "# A\n",
+		},
+		{name: "missing", url: "gemini://localhost/nope.md", header: "51 Not found"},
+		{name: "protected", url: "gemini://localhost/private/secret.md", header: "51 Not found"},
+		{name: "site config", url: "gemini://localhost/" + siteConfigName, header: "51 Not found"},
+		{name: "not gemini", url: "https://localhost/page.md", header: "59 Bad request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, body := geminiGet(t, addr, tt.url)
+			if header != tt.header {
+				t.Errorf("header %q, want %q", header, tt.header)
+			}
+			if body != tt.body {
+				t.Errorf("body:\n%s\nwant:\n%s", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestGeminiAuthRequired(t *testing.T) {
+	cfg := defaultSiteConfig()
+	cfg.Auth.Required = true
+	newTestSite(t, cfg, map[string]string{"page.md": "# Page\n"})
+	header, body := geminiGet(t, startGemini(t), "gemini://localhost/page.md")
+	if !strings.HasPrefix(header, "50 ") || body != "" {
+		t.Errorf("got %q %q, want status 50", header, body)
+	}
+}
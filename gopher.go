@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c4pt0r/log"
+)
+
+const (
+	defaultGopherAddr = ":70"
+	// gopherWidth is the column pages are reflowed at
+	gopherWidth = 70
+	// gopherTimeout bounds reading the selector and writing the response
+	gopherTimeout = 30 * time.Second
+)
+
+// gopherConfig is the "gopher" section of the site config.
+type gopherConfig struct {
+	Enabled bool   `json:"enabled"`
+	Addr    string `json:"addr"`
+	// Hostname and Port are put in the menus, the port defaults to the one
+	// of Addr, set it when it's different behind NAT or a proxy
+	Hostname string `json:"hostname"`
+	Port     int    `json:"port"`
+}
+
+func (c *gopherConfig) addr() string {
+	if c.Addr == "" {
+		return defaultGopherAddr
+	}
+	return c.Addr
+}
+
+// host returns the hostname and port of the menu items.
+func (c *gopherConfig) host() (string, int) {
+	host, port := c.Hostname, c.Port
+	if host == "" {
+		host = "localhost"
+	}
+	if port == 0 {
+		if _, p, err := net.SplitHostPort(c.addr()); err == nil {
+			port, _ = strconv.Atoi(p)
+		}
+	}
+	return host, port
+}
+
+// gopherServer serves the node tree, directories as menus and pages as
+// plain text.
+func gopherServer(cfg gopherConfig) error {
+	ln, err := net.Listen("tcp", cfg.addr())
+	if err != nil {
+		return err
+	}
+	log.I("Starting Gopher server on", cfg.addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handleGopher(conn, cfg)
+	}
+}
+
+func handleGopher(conn net.Conn, cfg gopherConfig) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(gopherTimeout))
+	line, err := bufio.NewReaderSize(conn, 1024).ReadSlice('\n')
+	if err != nil {
+		return
+	}
+	// a search string or Gopher+ flags may follow a tab
+	selector, _, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), "\t")
+	log.Infof("%s GOPHER %s", conn.RemoteAddr(), selector)
+	w := bufio.NewWriter(conn)
+	defer w.Flush()
+	if getSiteConfig().Auth.Required {
+		gopherError(w, "This site requires a login, use the web site")
+		return
+	}
+	if err := gopherResponse(w, selector, cfg); err != nil {
+		if os.IsNotExist(err) {
+			gopherError(w, "Not found")
+			return
+		}
+		log.E(err)
+		gopherError(w, "Internal error")
+	}
+}
+
+func gopherError(w io.Writer, msg string) {
+	fmt.Fprintf(w, "3%s\t\terror.host\t1\r\n.\r\n", msg)
+}
+
+// gopherResponse writes the menu, text or file of the selector.
+func gopherResponse(w io.Writer, selector string, cfg gopherConfig) error {
+	fpath, err := resolveNodePath(selector)
+	if err != nil {
+		return os.ErrNotExist
+	}
+	if !fileExists(fpath) && fileExists(fpath+".md") {
+		fpath += ".md"
+	}
+	n, err := newNodeFromPath(fpath)
+	if err != nil {
+		return err
+	}
+	if !isPublic(n) {
+		return os.ErrNotExist
+	}
+	if n.isDir {
+		return gopherMenu(w, n, cfg)
+	}
+	switch gopherType(n) {
+	case '0':
+		text, err := plainText(n)
+		if err != nil {
+			return err
+		}
+		return gopherText(w, text)
+	case 0:
+		return os.ErrNotExist
+	}
+	f, err := os.Open(n.filepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// gopherType returns the item type of a node, 0 for nodes that can't be
+// served like Lua scripts.
+func gopherType(n *node) byte {
+	if n.isDir {
+		return '1'
+	}
+	switch ext := n.ext(); ext {
+	case ".md", ".html", ".txt":
+		return '0'
+	case ".lua":
+		return 0
+	case ".gif":
+		return 'g'
+	default:
+		mimeType := mime.TypeByExtension(ext)
+		switch {
+		case strings.HasPrefix(mimeType, "text/"):
+			return '0'
+		case strings.HasPrefix(mimeType, "image/"):
+			return 'I'
+		}
+	}
+	return '9'
+}
+
+// plainText returns a page as plain text reflowed at gopherWidth.
+func plainText(n *node) (string, error) {
+	switch n.ext() {
+	case ".md":
+		content, err := readNodeMarkdown(n)
+		if err != nil {
+			return "", err
+		}
+		return gemtextToText(markdownToGemtext(n, content), gopherWidth), nil
+	case ".html":
+		content, err := os.ReadFile(n.filepath)
+		if err != nil {
+			return "", err
+		}
+		return gemtextToText(htmlToGemtext(string(content)), gopherWidth), nil
+	}
+	content, err := os.ReadFile(n.filepath)
+	return string(content), err
+}
+
+// gemtextToText reflows gemtext: headings are underlined, link lines become
+// "label <url>" and preformatted blocks are kept as they are.
+func gemtextToText(s string, width int) string {
+	var sb strings.Builder
+	pre := false
+	for _, line := range strings.Split(s, "\n") {
+		if strings.HasPrefix(line, "```") {
+			pre = !pre
+			continue
+		}
+		if pre {
+			sb.WriteString(line + "\n")
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "#"):
+			text := strings.TrimSpace(strings.TrimLeft(line, "#"))
+			underline := "-"
+			if strings.HasPrefix(line, "# ") {
+				underline = "="
+			}
+			sb.WriteString(text + "\n" + strings.Repeat(underline, min(len([]rune(text)), width)) + "\n")
+		case strings.HasPrefix(line, "=> "):
+			url, label, _ := strings.Cut(strings.TrimPrefix(line, "=> "), " ")
+			if label == "" {
+				label = url
+			} else {
+				label += " <" + url + ">"
+			}
+			sb.WriteString(wrapText(label, width, "  ", "    "))
+		case strings.HasPrefix(line, "* "):
+			sb.WriteString(wrapText(line[2:], width, "* ", "  "))
+		case strings.HasPrefix(line, "> "):
+			sb.WriteString(wrapText(line[2:], width, "> ", "> "))
+		default:
+			sb.WriteString(wrapText(line, width, "", ""))
+		}
+	}
+	return sb.String()
+}
+
+// wrapText wraps s at width columns, first prefixes the first line and
+// indent the others.
+func wrapText(s string, width int, first, indent string) string {
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		return "\n"
+	}
+	var sb strings.Builder
+	line := first + words[0]
+	for _, word := range words[1:] {
+		if len([]rune(line))+1+len([]rune(word)) > width {
+			sb.WriteString(line + "\n")
+			line = indent + word
+			continue
+		}
+		line += " " + word
+	}
+	sb.WriteString(line + "\n")
+	return sb.String()
+}
+
+// gopherText writes a text item: CRLF lines, dot escaped, ending with ".".
+func gopherText(w io.Writer, text string) error {
+	var buf bytes.Buffer
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, ".") {
+			line = "." + line
+		}
+		buf.WriteString(line + "\r\n")
+	}
+	buf.WriteString(".\r\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// gopherMenu writes the gophermap of a directory: its index page as info
+// lines, then an item per visible child, like the directory listings of
+// the web pages.
+func gopherMenu(w io.Writer, n *node, cfg gopherConfig) error {
+	host, port := cfg.host()
+	var buf bytes.Buffer
+	info := func(text string) {
+		for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+			buf.WriteString("i" + strings.ReplaceAll(line, "\t", " ") + "\t\terror.host\t1\r\n")
+		}
+	}
+	if filepath.Clean(n.filepath) == filepath.Clean(_rootDir) {
+		site := getSiteConfig()
+		info(site.SiteName)
+		if site.SiteSubtitle != "" {
+			info(site.SiteSubtitle)
+		}
+		info("")
+	}
+	if idx, err := getIndexNodeForDir(n.filepath); err == nil && idx != nil {
+		if text, err := plainText(idx); err == nil {
+			info(text)
+		}
+	} else {
+		info(n.title)
+	}
+	subnodes, err := n.getSubNodes()
+	if err != nil {
+		return err
+	}
+	info("")
+	for _, sub := range subnodes {
+		typ := gopherType(sub)
+		if sub.isHidden || typ == 0 || !isPublic(sub) {
+			continue
+		}
+		label := sub.title
+		selector := sub.href()
+		if sub.isDir {
+			label += "/"
+			selector = strings.TrimSuffix(selector, "/") + "/"
+		}
+		if sub.desc != "" {
+			label += " - " + sub.desc
+		}
+		fmt.Fprintf(&buf, "%c%s\t%s\t%s\t%d\r\n", typ, strings.ReplaceAll(label, "\t", " "), selector, host, port)
+	}
+	buf.WriteString(".\r\n")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
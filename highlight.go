@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+// highlightCSSPath is where the stylesheet of the configured style is
+// served when highlighting with CSS classes.
+const highlightCSSPath = "/_highlight.css"
+
+// highlightConfig is the "highlight" section of the site config.
+type highlightConfig struct {
+	// Disabled turns off server-side highlighting of fenced code blocks
+	Disabled bool `json:"disabled"`
+	// Style is a chroma style name, see https://xyproto.github.io/splash/docs/
+	Style string `json:"style"`
+	// Inline writes style attributes instead of CSS classes, so pages
+	// look right without the stylesheet
+	Inline      bool `json:"inline"`
+	LineNumbers bool `json:"line_numbers"`
+}
+
+func (c *highlightConfig) validate() error {
+	if _, ok := styles.Registry[c.Style]; !ok {
+		return fmt.Errorf("unknown highlight style: %s", c.Style)
+	}
+	return nil
+}
+
+func (c *highlightConfig) formatter() *chromahtml.Formatter {
+	return chromahtml.New(
+		chromahtml.WithClasses(!c.Inline),
+		chromahtml.WithLineNumbers(c.LineNumbers),
+	)
+}
+
+// highlightCode writes code as highlighted HTML, lang is the info string
+// of a fenced code block and may be empty.
+func highlightCode(w io.Writer, code string, lang string) error {
+	cfg := getSiteConfig().Highlight
+	var lexer chroma.Lexer
+	if lang != "" {
+		lexer = lexers.Get(lang)
+	} else {
+		lexer = lexers.Analyse(code)
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	it, err := chroma.Coalesce(lexer).Tokenise(nil, code)
+	if err != nil {
+		return err
+	}
+	return cfg.formatter().Format(w, styles.Get(cfg.Style), it)
+}
+
+// highlightSource writes a source file as highlighted HTML with line
+// numbers linking to themselves, #L10 is line 10. The language is guessed
+// from the file name, then the content.
+func highlightSource(w io.Writer, code string, filename string) error {
+	cfg := getSiteConfig().Highlight
+	lexer := lexers.Fallback
+	if !cfg.Disabled {
+		if l := lexers.Match(filename); l != nil {
+			lexer = l
+		} else if l := lexers.Analyse(code); l != nil {
+			lexer = l
+		}
+	}
+	it, err := chroma.Coalesce(lexer).Tokenise(nil, code)
+	if err != nil {
+		return err
+	}
+	f := chromahtml.New(
+		chromahtml.WithClasses(!cfg.Inline),
+		chromahtml.WithLineNumbers(true),
+		chromahtml.LineNumbersInTable(true),
+		chromahtml.WithLinkableLineNumbers(true, "L"),
+	)
+	return f.Format(w, styles.Get(cfg.Style), it)
+}
+
+// codeLang returns the language of a fenced code block from its info
+// string, e.g. "go" for "```go {.class}".
+func codeLang(info []byte) string {
+	fields := strings.Fields(string(info))
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+func serveHighlightCSS(w http.ResponseWriter, r *http.Request) {
+	cfg := getSiteConfig().Highlight
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	if err := cfg.formatter().WriteCSS(w, styles.Get(cfg.Style)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
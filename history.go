@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c4pt0r/log"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// historyConfig is the "history" section of the site config.
+type historyConfig struct {
+	// Enabled commits every write made through crew to a git repository
+	// of the root directory, created if needed
+	Enabled bool `json:"enabled"`
+	// Email is the domain of the commit authors' email, user@<email>
+	Email string `json:"email"`
+	// GitDir is where the repository is created when the root directory
+	// isn't in one, <root>.git next to the root directory by default. It's
+	// kept out of the root so it's never served.
+	GitDir string `json:"git_dir"`
+}
+
+// gitDir returns the git directory of the history of root.
+func (c historyConfig) gitDir(root string) string {
+	if c.GitDir != "" {
+		return c.GitDir
+	}
+	return filepath.Clean(root) + ".git"
+}
+
+// openHistoryRepo opens the repository in gitDir with root as work tree.
+func openHistoryRepo(gitDir, root string) (*git.Repository, error) {
+	st := filesystem.NewStorage(osfs.New(gitDir), cache.NewObjectLRUDefault())
+	return git.Open(st, osfs.New(root))
+}
+
+const (
+	// historyLimit is the max number of commits on a ?history page
+	historyLimit = 100
+	// defaultAuthor commits writes made without an authenticated user
+	defaultAuthor = "crew"
+)
+
+var (
+	// _repoMu guards _repo and serializes commits
+	_repoMu     sync.Mutex
+	_repo       *git.Repository
+	_repoOpened bool
+)
+
+// gitRepo returns the history repository of the root directory, or the
+// repository the root directory is in, nil if there's none.
+func gitRepo() *git.Repository {
+	_repoMu.Lock()
+	defer _repoMu.Unlock()
+	if !_repoOpened {
+		_repoOpened = true
+		var repo *git.Repository
+		var err error
+		if gitDir := getSiteConfig().History.gitDir(_rootDir); fileExists(gitDir) {
+			repo, err = openHistoryRepo(gitDir, _rootDir)
+		} else {
+			repo, err = git.PlainOpenWithOptions(_rootDir, &git.PlainOpenOptions{DetectDotGit: true})
+		}
+		if err == nil {
+			_repo = repo
+		} else if !errors.Is(err, git.ErrRepositoryNotExists) {
+			log.E(err)
+		}
+	}
+	return _repo
+}
+
+// initHistory creates the repository of the root directory when history
+// is enabled and there's none yet. Its git directory is outside the root.
+func initHistory() error {
+	cfg := getSiteConfig().History
+	if !cfg.Enabled || gitRepo() != nil {
+		return nil
+	}
+	gitDir := cfg.gitDir(_rootDir)
+	root, err := filepath.Abs(_rootDir)
+	if err != nil {
+		return err
+	}
+	// initialized without a work tree, go-git would otherwise write a .git
+	// file pointing to gitDir in the root
+	st := filesystem.NewStorage(osfs.New(gitDir), cache.NewObjectLRUDefault())
+	repo, err := git.Init(st, nil)
+	if err != nil {
+		return err
+	}
+	repoCfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	repoCfg.Core.IsBare = false
+	repoCfg.Core.Worktree = root
+	if err := repo.SetConfig(repoCfg); err != nil {
+		return err
+	}
+	if repo, err = openHistoryRepo(gitDir, _rootDir); err != nil {
+		return err
+	}
+	_repoMu.Lock()
+	_repo = repo
+	_repoMu.Unlock()
+	log.I("created git repository for history in", gitDir)
+	return nil
+}
+
+// repoPath returns the path of fpath relative to the work tree of repo, with
+// forward slashes.
+func repoPath(repo *git.Repository, fpath string) (string, error) {
+	wt, err := repo.Worktree()
+	if err != nil {
+		return "", err
+	}
+	root, err := filepath.Abs(wt.Filesystem.Root())
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(fpath)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s is outside of the repository", fpath)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// commitFiles commits the current state of files, written or removed, as
+// user. It does nothing unless history is enabled.
+func commitFiles(user, message string, files ...string) error {
+	if !getSiteConfig().History.Enabled {
+		return nil
+	}
+	repo := gitRepo()
+	if repo == nil {
+		return errors.New("history is enabled but there's no git repository")
+	}
+	_repoMu.Lock()
+	defer _repoMu.Unlock()
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		rel, err := repoPath(repo, f)
+		if err != nil {
+			return err
+		}
+		if fileExists(f) {
+			_, err = wt.Add(rel)
+		} else {
+			err = removeFromIndex(repo, wt, rel)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return err
+	}
+	staged := false
+	for _, s := range status {
+		if s.Staging != git.Unmodified && s.Staging != git.Untracked {
+			staged = true
+			break
+		}
+	}
+	if !staged {
+		return nil
+	}
+	if user == "" {
+		user = defaultAuthor
+	}
+	domain := getSiteConfig().History.Email
+	if domain == "" {
+		domain = "localhost"
+	}
+	_, err = wt.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{Name: user, Email: user + "@" + domain, When: time.Now()},
+	})
+	return err
+}
+
+// removeFromIndex stages the removal of a file, or of every file of a
+// directory, deleted from the work tree. Files never committed are fine.
+func removeFromIndex(repo *git.Repository, wt *git.Worktree, rel string) error {
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return err
+	}
+	for _, e := range idx.Entries {
+		if e.Name != rel && !strings.HasPrefix(e.Name, rel+"/") {
+			continue
+		}
+		if _, err := wt.Remove(e.Name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitChange commits files written or removed by the node while
+// handling the request in ctx, as the user it's authenticated as. Errors
+// are logged, the write itself succeeded.
+func commitChange(ctx context.Context, n *node, message string, files ...string) {
+	user := ""
+	if r, ok := ctx.Value("request").(*http.Request); ok {
+		user, _ = authenticatedUser(r, n)
+	}
+	if err := commitFiles(user, message, files...); err != nil {
+		log.E(err)
+	}
+}
+
+// contentFile returns the file holding the content of the node, the index
+// page for a directory, or "" if it has none.
+func (n *node) contentFile() string {
+	if !n.isDir {
+		return n.filepath
+	}
+	idx, err := getIndexNodeForDir(n.filepath)
+	if err != nil || idx == nil {
+		return ""
+	}
+	return idx.filepath
+}
+
+// fileHistory returns the commits touching the file, newest first.
+func fileHistory(repo *git.Repository, fpath string, limit int) ([]*object.Commit, error) {
+	rel, err := repoPath(repo, fpath)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := repo.Log(&git.LogOptions{FileName: &rel})
+	if err != nil {
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			// no commits yet
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer iter.Close()
+	var commits []*object.Commit
+	for len(commits) < limit {
+		c, err := iter.Next()
+		if err != nil {
+			break
+		}
+		commits = append(commits, c)
+	}
+	return commits, nil
+}
+
+// fileAt returns the content of the file in the commit, and false if it
+// doesn't exist there.
+func fileAt(repo *git.Repository, c *object.Commit, fpath string) (string, bool, error) {
+	rel, err := repoPath(repo, fpath)
+	if err != nil {
+		return "", false, err
+	}
+	f, err := c.File(rel)
+	if errors.Is(err, object.ErrFileNotFound) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	content, err := f.Contents()
+	return content, err == nil, err
+}
+
+// isHistoryRequest reports whether the request is for ?history, ?diff=rev
+// or ?revert=rev of a node.
+func isHistoryRequest(r *http.Request) bool {
+	q := r.URL.Query()
+	return q.Has("history") || q.Has("diff") || q.Has("revert")
+}
+
+// authenticatedUser returns the name of the user authenticated with basic
+// auth, against the node's or the site's users.
+func authenticatedUser(r *http.Request, n *node) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	for cur := n; cur != nil; cur, _ = cur.getParentNode() {
+		if cur.basicAuth.username != "" && cur.basicAuth.password != "" &&
+			checkBasicAuth(auth, cur.basicAuth.username, cur.basicAuth.password) {
+			return cur.basicAuth.username, true
+		}
+	}
+	for _, u := range getSiteConfig().Auth.Users {
+		if checkBasicAuth(auth, u.Username, u.Password) {
+			return u.Username, true
+		}
+	}
+	return "", false
+}
+
+// historyPage handles ?history, ?diff=rev and POST ?revert=rev for the
+// node. It returns nil when it already wrote the response.
+func historyPage(w http.ResponseWriter, r *http.Request, n *node) *page {
+	repo := gitRepo()
+	fpath := n.contentFile()
+	if repo == nil || fpath == "" {
+		http.NotFound(w, r)
+		return nil
+	}
+	q := r.URL.Query()
+	if q.Has("revert") {
+		revertFile(w, r, n, repo, fpath, q.Get("revert"))
+		return nil
+	}
+	if q.Has("diff") {
+		c, err := repo.CommitObject(plumbing.NewHash(q.Get("diff")))
+		if err != nil {
+			http.NotFound(w, r)
+			return nil
+		}
+		return diffPage(n, repo, fpath, c)
+	}
+
+	// the revert buttons are for users with write permission
+	user, canRevert := writeUser(r)
+	canRevert = canRevert && getSiteConfig().History.Enabled
+	p := pageFromNode(n)
+	p.Title = n.title + ": history"
+	p.bodyRender = func(p *page, ctx context.Context) ([]byte, error) {
+		commits, err := fileHistory(repo, fpath, historyLimit)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		buf.WriteString("<h1>History of <a href=\"" + n.href() + "\">" + n.title + "</a></h1>")
+		if len(commits) == 0 {
+			buf.WriteString("<p>No history.</p>")
+			return buf.Bytes(), nil
+		}
+		buf.WriteString("<table class=\"history\">")
+		for i, c := range commits {
+			hash := c.Hash.String()
+			buf.WriteString("<tr><td><a href=\"?diff=" + hash + "\"><code>" + hash[:7] + "</code></a></td>")
+			buf.WriteString("<td>" + c.Author.When.Format(modTimeFormat) + "</td>")
+			buf.WriteString("<td>" + html.EscapeString(c.Author.Name) + "</td>")
+			buf.WriteString("<td>" + html.EscapeString(strings.SplitN(c.Message, "\n", 2)[0]) + "</td><td>")
+			if i > 0 && canRevert {
+				buf.WriteString("<form method=\"post\" action=\"?revert=" + hash + "\">")
+				buf.WriteString("<input type=\"hidden\" name=\"csrf\" value=\"" + csrfToken(user) + "\">")
+				buf.WriteString("<button type=\"submit\">revert to this</button></form>")
+			}
+			buf.WriteString("</td></tr>")
+		}
+		buf.WriteString("</table>")
+		return buf.Bytes(), nil
+	}
+	return p
+}
+
+// diffPage shows the changes the commit made to the file.
+func diffPage(n *node, repo *git.Repository, fpath string, c *object.Commit) *page {
+	p := pageFromNode(n)
+	p.Title = n.title + ": " + c.Hash.String()[:7]
+	p.bodyRender = func(p *page, ctx context.Context) ([]byte, error) {
+		after, _, err := fileAt(repo, c, fpath)
+		if err != nil {
+			return nil, err
+		}
+		before := ""
+		if parent, err := c.Parent(0); err == nil {
+			if before, _, err = fileAt(repo, parent, fpath); err != nil {
+				return nil, err
+			}
+		}
+		var buf bytes.Buffer
+		buf.WriteString("<h1><a href=\"" + n.href() + "\">" + n.title + "</a> at <code>" + c.Hash.String()[:7] + "</code></h1>")
+		buf.WriteString("<p>" + html.EscapeString(c.Author.Name) + ", " + c.Author.When.Format(modTimeFormat) + ": " +
+			html.EscapeString(strings.TrimSpace(c.Message)) + " (<a href=\"?history\">history</a>)</p>")
+		buf.WriteString("<pre class=\"diff\">")
+		for _, d := range diff.Do(before, after) {
+			for _, line := range strings.SplitAfter(d.Text, "\n") {
+				if line == "" {
+					continue
+				}
+				switch d.Type {
+				case diffmatchpatch.DiffInsert:
+					buf.WriteString("<ins>+" + html.EscapeString(line) + "</ins>")
+				case diffmatchpatch.DiffDelete:
+					buf.WriteString("<del>-" + html.EscapeString(line) + "</del>")
+				default:
+					buf.WriteString(" " + html.EscapeString(line))
+				}
+			}
+		}
+		buf.WriteString("</pre>")
+		return buf.Bytes(), nil
+	}
+	return p
+}
+
+// revertFile restores the file as it was in the commit rev and commits it,
+// as the authenticated user, who needs write permission.
+func revertFile(w http.ResponseWriter, r *http.Request, n *node, repo *git.Repository, fpath, rev string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !getSiteConfig().History.Enabled {
+		http.Error(w, "history is disabled", http.StatusForbidden)
+		return
+	}
+	user, ok := checkWrite(w, r)
+	if !ok || !checkCSRF(w, r, user) {
+		return
+	}
+	c, err := repo.CommitObject(plumbing.NewHash(rev))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	content, ok, err := fileAt(repo, c, fpath)
+	if err != nil {
+		log.E(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "file doesn't exist in this revision", http.StatusBadRequest)
+		return
+	}
+	if err := os.WriteFile(fpath, []byte(content), 0644); err != nil {
+		log.E(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	rel, _ := repoPath(repo, fpath)
+	if err := commitFiles(user, fmt.Sprintf("Revert %s to %s", rel, rev[:min(7, len(rev))]), fpath); err != nil {
+		log.E(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, n.href()+"?history", http.StatusSeeOther)
+}
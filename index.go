@@ -0,0 +1,277 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/c4pt0r/log"
+)
+
+// siteIndex is a snapshot of the whole node tree with what's derived from
+// the content of every page, it's rebuilt when files change.
+type siteIndex struct {
+	// nodes are all the nodes but the root, in sitemap order
+	nodes []*node
+	// byPath maps the cleaned file path to the node
+	byPath map[string]*node
+	// byTitle maps the lower-cased title to the first node with that title
+	byTitle map[string]*node
+	// backlinks maps the path of a node to the nodes linking to it
+	backlinks map[string][]*node
+	// broken are the wiki links which don't resolve to any node
+	broken []brokenLink
+	// tags maps a tag to the nodes having it, in sitemap order
+	tags map[string][]*node
+	// visible maps the path of a node to whether it can be listed
+	// publicly, see isVisible
+	visible map[string]bool
+}
+
+type brokenLink struct {
+	from   *node
+	target string
+}
+
+var (
+	_siteIndex atomic.Pointer[siteIndex]
+)
+
+func getSiteIndex() *siteIndex {
+	return _siteIndex.Load()
+}
+
+// walkNodes calls fn for every node below root, depth first.
+func walkNodes(root *node, fn func(n *node)) {
+	subnodes, err := root.getSubNodes()
+	if err != nil {
+		log.E(err)
+		return
+	}
+	for _, n := range subnodes {
+		fn(n)
+		walkNodes(n, fn)
+	}
+}
+
+func buildSiteIndex() *siteIndex {
+	idx := &siteIndex{
+		byPath:    make(map[string]*node),
+		byTitle:   make(map[string]*node),
+		backlinks: make(map[string][]*node),
+		tags:      make(map[string][]*node),
+		visible:   make(map[string]bool),
+	}
+	root := getRootNode()
+	idx.visible[path.Clean(root.filepath)] = !root.isPrivate()
+	walkNodes(root, func(n *node) {
+		fpath := path.Clean(n.filepath)
+		idx.nodes = append(idx.nodes, n)
+		idx.byPath[fpath] = n
+		// parents are walked first
+		idx.visible[fpath] = !n.isPrivate() && idx.visible[path.Dir(fpath)]
+		title := strings.ToLower(n.title)
+		if _, ok := idx.byTitle[title]; !ok {
+			idx.byTitle[title] = n
+		}
+		for _, tag := range n.tags {
+			idx.tags[tag] = append(idx.tags[tag], n)
+		}
+	})
+	for _, n := range idx.nodes {
+		idx.indexLinks(n)
+	}
+	return idx
+}
+
+// rebuildSiteIndex builds a new index and swaps it in.
+func rebuildSiteIndex() {
+	start := time.Now()
+	idx := buildSiteIndex()
+	_siteIndex.Store(idx)
+	log.Infof("site index built, %d nodes in %s", len(idx.nodes), time.Since(start))
+}
+
+// isVisible reports whether n can be listed publicly, from the index when
+// it has the node.
+func (idx *siteIndex) isVisible(n *node) bool {
+	if idx != nil {
+		if v, ok := idx.visible[path.Clean(n.filepath)]; ok {
+			return v
+		}
+	}
+	return n.isVisible()
+}
+
+// lookup returns the indexed node for a file path.
+func (idx *siteIndex) lookup(fpath string) *node {
+	if idx == nil {
+		return nil
+	}
+	return idx.byPath[path.Clean(fpath)]
+}
+
+// scanTree returns the modification time of every file under dir, except
+// the git directory of a repository in it.
+func scanTree(dir string) map[string]time.Time {
+	m := make(map[string]time.Time)
+	filepath.WalkDir(dir, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if info, err := d.Info(); err == nil {
+			m[fpath] = info.ModTime()
+		}
+		return nil
+	})
+	return m
+}
+
+// diffTree returns the files changed (or added) and removed between two scans.
+func diffTree(old, cur map[string]time.Time) (changed, removed []string) {
+	for f, t := range cur {
+		if ot, ok := old[f]; !ok || !ot.Equal(t) {
+			changed = append(changed, f)
+		}
+	}
+	for f := range old {
+		if _, ok := cur[f]; !ok {
+			removed = append(removed, f)
+		}
+	}
+	return changed, removed
+}
+
+const (
+	// treeSettle is how long the tree must stay unchanged before the
+	// indexes are rebuilt, so that a burst of writes costs one rebuild
+	treeSettle = reloadInterval
+	// treeMaxDelay bounds the wait when the writes keep coming
+	treeMaxDelay = 10 * reloadInterval
+)
+
+// _treeWrites receives the files written by crew itself, see invalidateTree.
+var _treeWrites = make(chan []string, 64)
+
+// treeChanges collects the changes of the tree until it settles.
+type treeChanges struct {
+	changed, removed map[string]bool
+	first, last      time.Time
+}
+
+func (c *treeChanges) add(now time.Time, changed, removed []string) {
+	if len(changed) == 0 && len(removed) == 0 {
+		return
+	}
+	if c.changed == nil {
+		c.changed, c.removed = make(map[string]bool), make(map[string]bool)
+		c.first = now
+	}
+	c.last = now
+	for _, f := range changed {
+		c.changed[f] = true
+		delete(c.removed, f)
+	}
+	for _, f := range removed {
+		c.removed[f] = true
+		delete(c.changed, f)
+	}
+}
+
+// ready reports whether there are changes and the tree settled, or they
+// waited long enough.
+func (c *treeChanges) ready(now time.Time) bool {
+	return c.changed != nil && (now.Sub(c.last) >= treeSettle || now.Sub(c.first) >= treeMaxDelay)
+}
+
+// take returns the changes collected so far and forgets them.
+func (c *treeChanges) take() (changed, removed []string) {
+	for f := range c.changed {
+		changed = append(changed, f)
+	}
+	for f := range c.removed {
+		removed = append(removed, f)
+	}
+	*c = treeChanges{}
+	return changed, removed
+}
+
+// watchTree polls the root directory, rebuilds the site index and updates
+// the search index once the changes in it settle. The commit index follows
+// HEAD, which can move without a change in the root directory.
+func watchTree() {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	updateCommitIndex()
+	last := scanTree(_rootDir)
+	var pending treeChanges
+	for {
+		select {
+		case files := <-_treeWrites:
+			pending.add(time.Now(), files, nil)
+			continue
+		case <-ticker.C:
+		}
+		updateCommitIndex()
+		cur := scanTree(_rootDir)
+		changed, removed := diffTree(last, cur)
+		last = cur
+		now := time.Now()
+		pending.add(now, changed, removed)
+		if !pending.ready(now) {
+			continue
+		}
+		changed, removed = pending.take()
+		clearTemplateCache()
+		rebuildSiteIndex()
+		getSearchIndex().update(changed, removed)
+	}
+}
+
+// invalidateTree tells watchTree about files written by crew, so that the
+// indexes are rebuilt once the writes settle even if their modification
+// times didn't change.
+func invalidateTree(files ...string) {
+	select {
+	case _treeWrites <- files:
+	default:
+		// watchTree is busy or not running, the next scan still sees the
+		// files
+	}
+}
+
+// markdownSource returns the markdown file holding the content of a node,
+// the index.md of a directory, or "" if the node isn't markdown.
+func (n *node) markdownSource() string {
+	if !n.isDir {
+		if n.ext() == ".md" {
+			return n.filepath
+		}
+		return ""
+	}
+	if fpath := path.Join(n.filepath, "index.md"); fileExists(fpath) &&
+		!fileExists(path.Join(n.filepath, "index.html")) {
+		return fpath
+	}
+	return ""
+}
+
+func readMarkdownSource(n *node) ([]byte, bool) {
+	src := n.markdownSource()
+	if src == "" {
+		return nil, false
+	}
+	content, err := os.ReadFile(src)
+	if err != nil {
+		log.E(err)
+		return nil, false
+	}
+	return stripFrontMatter(content), true
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTreeChanges(t *testing.T) {
+	var c treeChanges
+	start := time.Now()
+	if c.ready(start) {
+		t.Fatal("ready without changes")
+	}
+
+	// a burst of writes is applied once the tree settles
+	c.add(start, []string{"a", "b"}, nil)
+	c.add(start.Add(treeSettle/2), nil, []string{"b"})
+	c.add(start.Add(treeSettle), []string{"c"}, nil)
+	if c.ready(start.Add(treeSettle * 3 / 2)) {
+		t.Error("ready before the tree settled")
+	}
+	if !c.ready(start.Add(2 * treeSettle)) {
+		t.Error("not ready after the tree settled")
+	}
+	changed, removed := c.take()
+	sort.Strings(changed)
+	if got := strings.Join(changed, " ") + " / " + strings.Join(removed, " "); got != "a c / b" {
+		t.Errorf("changes %q, want %q", got, "a c / b")
+	}
+	if c.ready(start.Add(time.Hour)) {
+		t.Error("ready after the changes were taken")
+	}
+
+	// writes that keep coming are applied after treeMaxDelay
+	for d := time.Duration(0); d < treeMaxDelay; d += treeSettle / 2 {
+		c.add(start.Add(d), []string{"a"}, nil)
+		if c.ready(start.Add(d)) {
+			t.Fatalf("ready %s after the first change", d)
+		}
+	}
+	if !c.ready(start.Add(treeMaxDelay)) {
+		t.Error("not ready after treeMaxDelay")
+	}
+}
@@ -4,104 +4,156 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
-	"sort"
 	"strings"
 	"sync"
-	"text/template"
+	"sync/atomic"
+	"time"
 
 	"encoding/base64"
 
 	"github.com/c4pt0r/log"
-	"github.com/gomarkdown/markdown"
 	lua "github.com/yuin/gopher-lua"
 )
 
 var (
-	// rootDir is the root directory of the website.
-	rootDir      = flag.String("rootDir", "./site", "root directory")
-	siteName     = flag.String("sitename", "crew", "site name")
-	siteSubtitle = flag.String("site-subtitle", "Bringing more minimalism and sanity to the web, in a suckless way", "site name")
-	// customPageTpl is the path to a custom page template.
-	customPageTpl   = flag.String("page-tpl", "", "custom page template file, use -print-page-tpl to print the default template")
+	// configFile is the path to the site config file.
+	configFile      = flag.String("config", "", "site config file, default is "+siteConfigName+" in the root directory")
 	printDefaultTpl = flag.Bool("print-default-page-template", false, "print the default page template")
-	basenameMode    = flag.Bool("basename-mode", false, "run crew in basename mode, rendering URLs without .md suffix")
 	// _rootDir is the absolute path to the root directory
 	_rootDir string
-	// addr is the address to listen on.
-	addr = flag.String("addr", ":8080", "address to listen on")
 )
 
+func init() {
+	registerConfigFlags(flag.CommandLine)
+}
+
+// registerConfigFlags defines the flags overriding the site config, see
+// siteConfig.applyFlags.
+func registerConfigFlags(fs *flag.FlagSet) {
+	def := defaultSiteConfig()
+	fs.String("rootDir", def.RootDir, "root directory")
+	fs.String("sitename", def.SiteName, "site name")
+	fs.String("site-subtitle", def.SiteSubtitle, "site subtitle")
+	fs.String("page-tpl", def.PageTpl, "custom page template file, use -print-default-page-template to print the default template")
+	fs.Bool("basename-mode", def.BasenameMode, "run crew in basename mode, rendering URLs without .md suffix")
+	fs.String("addr", def.Addr, "address to listen on")
+	fs.Bool("dev", def.Dev, "show config and template reload errors on pages")
+}
+
 var (
 	pageTpl = `<!DOCTYPE html>
 <html>
 <head>
     <title>{{ .Title }}</title>
-	<link rel="shortcut icon" href="/_static/favicon.ico" type="image/vnd.microsoft.icon">
+	<link rel="shortcut icon" href="{{ .Site.Favicon }}" type="image/vnd.microsoft.icon">
 
-	<link rel="stylesheet" href="/_static/highlight.js/default.min.css">
-    <script src="/_static/highlight.js/highlight.min.js"></script>
-    <script>hljs.initHighlightingOnLoad();</script>
+{{- if not .Site.Highlight.Inline }}
+    <link rel="stylesheet" href="/_highlight.css" type="text/css">
+{{- end }}
 
     <link rel="stylesheet" href="/_static/style.css" type="text/css" media="screen, handheld" title="default">
-    <link rel="shortcut icon" href="/_static/favicon.ico" type="image/vnd.microsoft.icon">
+{{- range .Site.ExtraCSS }}
+    <link rel="stylesheet" href="{{ . }}" type="text/css">
+{{- end }}
+{{- range .Site.ExtraJS }}
+    <script src="{{ . }}"></script>
+{{- end }}
     <meta charset="UTF-8">
     <meta http-equiv="Content-Type" content="text/html; charset=UTF-8"> 
+{{- range .Site.Meta }}
+    <meta name="{{ .Name }}" content="{{ .Content }}">
+{{- end }}
 </head>
 <body>
 
+{{ block "header" . }}
 <header>
     <nav class="head-nav">
 		<div class="left">
-			<a href="http://quotes.cat-v.org">quotes</a> |
-			<a href="http://doc.cat-v.org">docs</a> |
-			<a href="http://repo.cat-v.org">repo</a> |
-			<a href="http://go-lang.cat-v.org">golang</a> |
-			<a href="http://sam.cat-v.org">sam</a> |
-			<a href="http://man.cat-v.org">man</a> |
-			<a href="http://acme.cat-v.org">acme</a> |
-			<a href="http://glenda.cat-v.org">Glenda</a> |
-			<a href="http://ninetimes.cat-v.org">9times</a> |
-			<a href="http://harmful.cat-v.org">harmful</a> |
-			<a href="http://9p.cat-v.org/">9P</a> |
-			<a href="http://cat-v.org">cat-v.org</a>
+		{{- range $i, $l := .Site.HeaderLinks }}{{ if $i }} |{{ end }}
+			<a href="{{ $l.URL }}">{{ $l.Title }}</a>
+		{{- end }}
 		</div>
 
 		<div class="right">
 		  <span class="doNotDisplay">Related sites:</span>
 		  | <a href="/sitemap">site map</a>
+		  | <a href="/search">search</a>
+		  | <a href="/_recent">recent changes</a>
 		</div>
     </nav>
     <h1><a href="/">{{ .Headline }} <span id="headerSubTitle">{{ .SubHeadline }}</span></a></h1>
 </header>
+{{ end }}
 
+{{ block "nav" . }}
 <nav id="side-bar">
     <div>
 		{{ .Nav }}
 	</div>
 </nav>
+{{ end }}
 
 <article>
+{{- if .Breadcrumbs }}
+	<nav class="breadcrumbs">
+	{{- range .Breadcrumbs }}
+		<a href="{{ .URL }}">{{ .Title }}</a> ›
+	{{- end }}
+		<span>{{ .Title }}</span>
+	</nav>
+{{- end }}
 	{{ .Body }}
+{{- if .Tags }}
+	<p class="tags">Tags:
+	{{- range .Tags }}
+		<a href="{{ .URL }}">{{ .Name }}</a>
+	{{- end }}
+	</p>
+{{- end }}
+{{- if not .Modified.IsZero }}
+	<p class="modified">Last edited {{ .Modified.Format "2006-01-02 15:04" }}
+	{{- with .LastCommit }} by {{ .Author }} ({{ .Short }}), <a href="?history">history</a>{{ end }}
+	{{- if .Editable }}, <a href="?edit">edit</a>{{ end }}</p>
+{{- end }}
+{{- if .Backlinks }}
+	<section class="backlinks">
+		<h4>Linked from</h4>
+		<ul>
+		{{- range .Backlinks }}
+			<li><a href="{{ .URL }}">{{ .Title }}</a></li>
+		{{- end }}
+		</ul>
+	</section>
+{{- end }}
+{{- if or .Prev .Next }}
+	<nav class="pager">
+		{{ with .Prev }}<a class="prev" href="{{ .URL }}">« {{ .Title }}</a>{{ end }}
+		{{ with .Next }}<a class="next" href="{{ .URL }}">{{ .Title }} »</a>{{ end }}
+	</nav>
+{{- end }}
 </article>
 
+{{ block "footer" . }}
 <footer>
 <br class="doNotDisplay doNotPrint" />
-<div style="margin-right: auto;"><a href="http://crew.0xffff.me">Powered by crew</a></div>
+<div style="margin-right: auto;">{{ .Footer }}</div>
 </footer>
+{{ end }}
 </body></html>
 `
 )
 var (
-	// for render navbar & sitemap
-	_rootNode *node
+	// for render navbar & sitemap, swapped on reload
+	_rootNode atomic.Pointer[node]
 )
 
 // state is the global state for lua scripts
@@ -135,27 +187,7 @@ var (
 )
 
 func getRootNode() *node {
-	return _rootNode
-}
-
-func init() {
-	flag.Parse()
-	var err error
-
-	_rootDir = *rootDir
-	_rootNode, err = newNodeFromPath(_rootDir)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if *customPageTpl != "" {
-		// read template file and replace pageTpl
-		b, err := os.ReadFile(*customPageTpl)
-		if err != nil {
-			log.Fatal(err)
-		}
-		pageTpl = string(b)
-	}
+	return _rootNode.Load()
 }
 
 type NodeType int
@@ -192,20 +224,67 @@ type node struct {
 	rpcEndpoint string
 	title       string
 	desc        string
-	isDir       bool
-	isHidden    bool
-	tp          NodeType
-	authToken   string
-	basicAuth   struct {
+	// date is the publication date from front matter or .conf.json
+	date time.Time
+	// modTime is the modification time of the file or directory
+	modTime  time.Time
+	isDir    bool
+	isHidden bool
+	// toc puts a table of contents on top of markdown pages without a [TOC] marker
+	toc bool
+	// markdown overrides the markdown settings for the node and its subtree
+	markdown *markdownConfig
+	// feed serves feed.xml and atom.xml for a directory
+	feed      bool
+	feedLimit int
+	feedOrder string
+	// weight moves the node up (lower) or down (higher) among its siblings
+	weight int
+	// order is how a directory sorts its children, "title" or "date"
+	order string
+	// tags are lower-cased and distinct
+	tags []string
+	// mode "blog" renders a directory as a paginated list of posts
+	mode    string
+	perPage int
+	// layout is the name of a template in _layouts used to render the node
+	layout    string
+	tp        NodeType
+	authToken string
+	basicAuth struct {
 		username string
 		password string
 	}
 }
 
 type nodeConf struct {
-	Title    string `json:"title'"`
-	Desc     string `json:"desc"`
+	Title string `json:"title"`
+	Desc  string `json:"desc"`
+	// Date is the publication date, e.g. 2006-01-02 or RFC 3339
+	Date     string `json:"date"`
 	IsHidden bool   `json:"hidden"`
+	// TOC adds a table of contents to a markdown page, use a [TOC] line to place it
+	TOC bool `json:"toc"`
+	// Markdown sets markdown extensions, renderer flags and profile for the node and its subtree
+	Markdown *markdownConfig `json:"markdown"`
+	// Feed serves RSS (feed.xml) and Atom (atom.xml) feeds of a directory's children
+	Feed bool `json:"feed"`
+	// FeedLimit is the max number of entries in the feeds
+	FeedLimit int `json:"feed_limit"`
+	// FeedOrder is "date" (newest first) or "title"
+	FeedOrder string `json:"feed_order"`
+	// Weight orders the node among its siblings, lower first, before the directory's order applies
+	Weight int `json:"weight"`
+	// Order is how a directory sorts its children: "title" (directories first) or "date" (newest first)
+	Order string `json:"order"`
+	// Tags list the node on the /_tags/<tag> pages
+	Tags []string `json:"tags"`
+	// Mode "blog" renders a directory as its posts, newest first, with year and month archives
+	Mode string `json:"mode"`
+	// PerPage is the number of posts on a page of a blog
+	PerPage int `json:"per_page"`
+	// Layout is the name of a template in the _layouts directory, it applies to the whole subtree
+	Layout string `json:"layout"`
 	// Type is the type of the node, it can be "file"
 	Tp string `json:"type"`
 	// Key is the key to the node in the database if the node type is "kv", default value is the node URL
@@ -237,7 +316,7 @@ func (n *node) URL() string {
 	relPath = "/" + relPath
 
 	// trim ".md" suffix from node URL if running in basename mode
-	if *basenameMode {
+	if getSiteConfig().BasenameMode {
 		relPath = strings.TrimSuffix(relPath, ".md")
 	}
 	return relPath
@@ -247,6 +326,8 @@ func isReservedName(name string) bool {
 	if strings.HasPrefix(name, ".") ||
 		strings.HasPrefix(name, "_") ||
 		strings.HasSuffix(name, ".conf.json") ||
+		name == siteConfigName ||
+		name == robotsName ||
 		name == "index.html" ||
 		name == "index.md" {
 		return true
@@ -277,20 +358,10 @@ func (n *node) getSubNodes() ([]*node, error) {
 		ns = append(ns, node)
 	}
 	// sort the nodes
-	sortNodes(ns)
+	sortNodes(n, ns)
 	return ns, nil
 }
 
-func sortNodes(ns []*node) {
-	// sort the nodes, directories first, then files
-	sort.Slice(ns, func(i, j int) bool {
-		if ns[i].isDir && !ns[j].isDir {
-			return true
-		}
-		return ns[i].title < ns[j].title
-	})
-}
-
 func (n *node) getParentNode() (*node, error) {
 	// get the parent directory
 	if path.Clean(n.filepath) == path.Clean(_rootDir) {
@@ -301,6 +372,24 @@ func (n *node) getParentNode() (*node, error) {
 	return newNodeFromPath(parentDir)
 }
 
+// isVisible reports whether the node can be listed publicly: neither the
+// node nor any of its parents is hidden or protected by auth. Listings use
+// the site index, which has it for every node, see siteIndex.isVisible.
+func (n *node) isVisible() bool {
+	for cur := n; cur != nil; cur, _ = cur.getParentNode() {
+		if cur.isPrivate() {
+			return false
+		}
+	}
+	return true
+}
+
+// isPrivate reports whether the node itself is hidden or protected by auth.
+func (n *node) isPrivate() bool {
+	return n.isHidden || n.authToken != "" ||
+		(n.basicAuth.username != "" && n.basicAuth.password != "")
+}
+
 func (n *node) ext() string {
 	return filepath.Ext(n.filepath)
 }
@@ -309,27 +398,15 @@ func (n *node) Render(ctx context.Context) ([]byte, error) {
 	if n.isDir {
 		return n.renderDir(ctx)
 	}
-	switch n.ext() {
-	case ".md":
-		return n.renderMarkdown(ctx)
-	case ".html":
-		return n.renderHTML(ctx)
-	case ".lua":
-		return n.renderLua(ctx)
-	default:
-		return n.renderHTML(ctx)
-	}
+	return n.renderer().Render(ctx, n)
 }
 
-func (n *node) renderMarkdown(ctx context.Context) ([]byte, error) {
-	filePath := n.filepath
-	content, err := os.ReadFile(filePath)
-	if err != nil {
-		return nil, err
+// renderer returns the renderer of the file of the node.
+func (n *node) renderer() Renderer {
+	if n.isDir {
+		return htmlRenderer{}
 	}
-	// convert markdown to html
-	output := markdown.ToHTML(content, nil, nil)
-	return output, nil
+	return rendererFor(n.ext())
 }
 
 func (n *node) renderHTML(ctx context.Context) ([]byte, error) {
@@ -391,6 +468,9 @@ func getIndexNodeForDir(dir string) (*node, error) {
 }
 
 func (n *node) renderDir(ctx context.Context) ([]byte, error) {
+	if n.isBlog() {
+		return n.renderBlog(ctx)
+	}
 	// if there's _index.md or _index.html, render that
 	if indexNode, err := getIndexNodeForDir(n.filepath); err == nil && indexNode != nil {
 		return indexNode.Render(ctx)
@@ -437,19 +517,19 @@ func fileExists(fpath string) bool {
 	return true
 }
 
-func getConfigFileForFile(fpath string) (bool, string, error) {
+func getConfigFileForFile(fpath string) (os.FileInfo, string, error) {
 	cfgPath := ""
 	info, err := os.Stat(fpath)
 	if err != nil {
-		return false, "", err
+		return nil, "", err
 	}
 	if !info.IsDir() {
 		dir, fn := path.Split(fpath)
 		cfgPath = path.Join(dir, fn+".conf.json")
-		return false, cfgPath, nil
+		return info, cfgPath, nil
 	} else {
 		cfgPath = path.Join(fpath, ".conf.json")
-		return true, cfgPath, nil
+		return info, cfgPath, nil
 	}
 }
 
@@ -458,11 +538,24 @@ func newNodeFromPath(fullname string) (*node, error) {
 	// check if is a directory
 	fname := filepath.Base(fpath)
 	title := strings.TrimSuffix(fname, filepath.Ext(fname))
+	// posts can be named 2006-01-02-title.md
+	date, title, _ := splitDatePrefix(title)
 	// replace underscores with spaces
 	title = strings.Replace(title, "_", " ", -1)
 	// node desc
 	desc := ""
 	hidden := false
+	toc := false
+	var md *markdownConfig
+	feed := false
+	feedLimit := 0
+	feedOrder := ""
+	weight := 0
+	order := ""
+	var tags []string
+	mode := ""
+	perPage := 0
+	layout := ""
 	tp := "file"
 	key := ""
 	rpcEndpoint := ""
@@ -472,10 +565,22 @@ func newNodeFromPath(fullname string) (*node, error) {
 		password string
 	}{}
 
-	isDir, cfgPath, err := getConfigFileForFile(fpath)
+	info, cfgPath, err := getConfigFileForFile(fpath)
 	if err != nil {
 		return nil, err
 	}
+	isDir := info.IsDir()
+	// front matter of markdown files first, .conf.json wins over it
+	var confs []*nodeConf
+	if !isDir && filepath.Ext(fpath) == ".md" {
+		cfg, err := readFrontMatter(fpath)
+		if err != nil {
+			return nil, err
+		}
+		if cfg != nil {
+			confs = append(confs, cfg)
+		}
+	}
 	if fileExists(cfgPath) {
 		data, err := os.ReadFile(cfgPath)
 		if err != nil {
@@ -486,15 +591,68 @@ func newNodeFromPath(fullname string) (*node, error) {
 		if err != nil {
 			return nil, err
 		}
+		confs = append(confs, &cfg)
+	}
+	for _, cfg := range confs {
 		if len(cfg.Title) > 0 {
 			title = cfg.Title
 		}
 		if len(cfg.Desc) > 0 {
 			desc = cfg.Desc
 		}
+		if len(cfg.Date) > 0 {
+			if date, err = parseDate(cfg.Date); err != nil {
+				return nil, fmt.Errorf("%s: %w", fpath, err)
+			}
+		}
 		if cfg.IsHidden {
 			hidden = true
 		}
+		if cfg.TOC {
+			toc = true
+		}
+		if cfg.Markdown != nil {
+			md = cfg.Markdown
+		}
+		if cfg.Feed {
+			feed = true
+		}
+		if cfg.FeedLimit > 0 {
+			feedLimit = cfg.FeedLimit
+		}
+		if len(cfg.FeedOrder) > 0 {
+			if err := validateFeedOrder(cfg.FeedOrder); err != nil {
+				return nil, fmt.Errorf("%s: %w", fpath, err)
+			}
+			feedOrder = cfg.FeedOrder
+		}
+		if cfg.Weight != 0 {
+			weight = cfg.Weight
+		}
+		if len(cfg.Order) > 0 {
+			if err := validateOrder(cfg.Order); err != nil {
+				return nil, fmt.Errorf("%s: %w", fpath, err)
+			}
+			order = cfg.Order
+		}
+		if len(cfg.Tags) > 0 {
+			tags = normalizeTags(cfg.Tags)
+		}
+		if len(cfg.Mode) > 0 {
+			if err := validateMode(cfg.Mode); err != nil {
+				return nil, fmt.Errorf("%s: %w", fpath, err)
+			}
+			mode = cfg.Mode
+		}
+		if cfg.PerPage > 0 {
+			perPage = cfg.PerPage
+		}
+		if len(cfg.Layout) > 0 {
+			if err := validateLayout(cfg.Layout); err != nil {
+				return nil, fmt.Errorf("%s: %w", fpath, err)
+			}
+			layout = cfg.Layout
+		}
 		if len(cfg.Tp) > 0 {
 			tp = cfg.Tp
 			if cfg.Tp == NodeTypeFile.String() && cfg.RpcEndpoint != "" {
@@ -513,7 +671,20 @@ func newNodeFromPath(fullname string) (*node, error) {
 		filepath:    fpath,
 		title:       title,
 		desc:        desc,
+		date:        date,
+		modTime:     info.ModTime(),
 		isHidden:    hidden,
+		toc:         toc,
+		markdown:    md,
+		feed:        feed,
+		feedLimit:   feedLimit,
+		feedOrder:   feedOrder,
+		weight:      weight,
+		order:       order,
+		tags:        tags,
+		mode:        mode,
+		perPage:     perPage,
+		layout:      layout,
 		isDir:       isDir,
 		tp:          NodeTypeFromStr(tp),
 		key:         key,
@@ -544,15 +715,37 @@ type page struct {
 	Nav         string
 	Body        string
 	Title       string
-	Vals        map[string]string
-	bodyRender  func(p *page, ctx context.Context) ([]byte, error)
+	// TOC is the table of contents of a markdown body
+	TOC []*tocEntry
+	// Backlinks are the pages linking to this one with [[wiki links]]
+	Backlinks []pageLink
+	// Breadcrumbs are the links from the root to the parent of the page
+	Breadcrumbs []pageLink
+	// Prev and Next are the pages around this one in its directory, or nil
+	Prev *pageLink
+	Next *pageLink
+	// Tags are the tags of the page with the number of pages having them
+	Tags []tagLink
+	// Modified is the modification time of the page's content, zero for
+	// generated pages
+	Modified time.Time
+	// LastCommit is the last git commit of the page's content, or nil
+	LastCommit *commitInfo
+	// Editable is true for markdown and HTML pages when the request is
+	// from a user with write permission
+	Editable   bool
+	Site       *siteConfig
+	Vals       map[string]string
+	bodyRender func(p *page, ctx context.Context) ([]byte, error)
 }
 
 func pageFromNode(n *node) *page {
 	p := &page{
 		node:        n,
-		Headline:    *siteName,
-		SubHeadline: *siteSubtitle,
+		Headline:    getSiteConfig().SiteName,
+		SubHeadline: getSiteConfig().SiteSubtitle,
+		Site:        getSiteConfig(),
+		Footer:      getSiteConfig().footerHTML,
 	}
 	p.Title = n.title
 	return p
@@ -644,17 +837,32 @@ func (p *page) renderNav() ([]byte, error) {
 	return []byte(out), nil
 }
 
+// contentType returns the media type of the rendered page, HTML unless
+// the renderer of the node is standalone or the raw file was asked for.
+func (p *page) contentType(r *http.Request, content []byte) string {
+	if p.bodyRender == nil && isRawRequest(r, p.node) {
+		return rawContentType(p.node, content)
+	}
+	if p.bodyRender == nil && p.node.renderer().Standalone() {
+		return p.node.renderer().ContentType(p.node)
+	}
+	return htmlContentType
+}
+
 func (p *page) Render(ctx context.Context) ([]byte, error) {
 	// if raw flag is set, just return the raw data
-	if params, ok := ctx.Value("params").(map[string]string); ok {
-		if v, ok := params["raw"]; ok && (v == "true" || v == "1") {
-			return p.node.rawContent()
-		}
+	if r, ok := ctx.Value("request").(*http.Request); ok && p.bodyRender == nil && isRawRequest(r, p.node) {
+		return p.node.rawContent()
+	}
+	if p.bodyRender == nil && p.node.renderer().Standalone() {
+		return p.node.Render(ctx)
 	}
-	tpl, err := template.New("page").Parse(pageTpl)
+	tpl, err := loadPageTemplate(p.node)
 	if err != nil {
 		return nil, err
 	}
+	// let the body renderers fill in the page, e.g. the TOC
+	ctx = context.WithValue(ctx, "page", p)
 
 	// get the body
 	var body []byte
@@ -669,7 +877,19 @@ func (p *page) Render(ctx context.Context) ([]byte, error) {
 			return nil, err
 		}
 	}
-	p.Body = string(body)
+	p.Body = devBanner() + string(body)
+	if p.bodyRender == nil {
+		p.Backlinks = getSiteIndex().backlinksOf(p.node)
+		p.Breadcrumbs = p.node.breadcrumbs()
+		p.Prev, p.Next = p.node.siblings()
+		p.Tags = getSiteIndex().tagLinks(p.node)
+		p.Modified = p.node.lastMod()
+		p.LastCommit = p.node.lastCommit()
+		if r, ok := ctx.Value("request").(*http.Request); ok {
+			_, canWrite := writeUser(r)
+			p.Editable = canWrite && p.node.isEditable()
+		}
+	}
 	// get nav
 	nav, err := p.renderNav()
 	if err != nil {
@@ -692,6 +912,9 @@ func serverStatic(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	if maxAge := getSiteConfig().Cache.StaticMaxAge; maxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	}
 	// serve the file
 	http.ServeFile(w, r, filepath)
 }
@@ -706,26 +929,63 @@ func getQueryParams(r *http.Request) map[string]string {
 }
 
 func httpServer(addr string) error {
+	http.HandleFunc(apiPrefix, serveAPI)
+	if cfg := getSiteConfig().WebDAV; cfg.Enabled {
+		http.Handle(cfg.prefix(), newWebDAVHandler(cfg.prefix()))
+		log.I("Serving WebDAV at", cfg.prefix())
+	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// get the path from the request, and remove the leading slash
 		var page *page
 		log.Infof("%s %s %s", r.RemoteAddr, r.Method, r.URL)
+		if !checkSiteAuth(w, r) {
+			return
+		}
 		path := r.URL.Path[1:]
 		if strings.HasPrefix(path, "_static") {
 			serverStatic(w, r)
 			return
-		} else if strings.HasPrefix(path, "sitemap") {
+		} else if r.URL.Path == highlightCSSPath {
+			serveHighlightCSS(w, r)
+			return
+		} else if r.URL.Path == searchPath {
+			page = searchPage(r)
+		} else if r.URL.Path == tagsPath || strings.HasPrefix(r.URL.Path, tagsPath+"/") {
+			page = tagsPage(r)
+		} else if r.URL.Path == recentPath {
+			page = recentPage(r)
+		} else if r.URL.Path == brokenLinksPath {
+			page = brokenLinksPage()
+		} else if r.URL.Path == sitemapXMLPath {
+			serveSitemapXML(w, r)
+			return
+		} else if r.URL.Path == robotsPath {
+			serveRobots(w, r)
+			return
+		} else if path == "sitemap" || path == "sitemap/" {
 			// site map
 			page = sitemapPage()
 		} else {
-			// get the node for the path
-			fpath := filepath.Join(_rootDir, path)
+			// get the node for the path, dot files, the site config and the
+			// other protected files are not served
+			fpath, err := resolveNodePath(path)
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
 
-			// fallback to adding "*.md" suffix to file path if no file found
-			// this ensures correct functioning of basename mode, disabled by default
-			if _, err := os.Stat(fpath); errors.Is(err, os.ErrNotExist) {
-				fpath = filepath.Join(_rootDir, path+".md")
+			// feeds of directories, unless there's a real file with that name
+			if name := filepath.Base(fpath); (name == rssFeedName || name == atomFeedName) && !fileExists(fpath) {
+				dir, err := newNodeFromPath(filepath.Dir(fpath))
+				if err != nil || !dir.hasFeed() || !dir.isVisible() {
+					http.NotFound(w, r)
+					return
+				}
+				serveFeed(w, r, dir, name)
+				return
 			}
+
+			fpath, archiveYear, archiveMonth := resolvePageFile(path, fpath)
 			node, err := newNodeFromPath(fpath)
 			if err != nil {
 				if os.IsNotExist(err) {
@@ -787,7 +1047,19 @@ func httpServer(addr string) error {
 				w.Write(content)
 				return
 			}
-			page = pageFromNode(node)
+			if isEditRequest(r) {
+				if page = editPage(w, r, node); page == nil {
+					return
+				}
+			} else if isHistoryRequest(r) {
+				if page = historyPage(w, r, node); page == nil {
+					return
+				}
+			} else if archiveYear > 0 {
+				page = blogArchivePage(node, archiveYear, archiveMonth)
+			} else {
+				page = pageFromNode(node)
+			}
 		}
 		// Add request to context
 		ctx := context.WithValue(
@@ -801,12 +1073,31 @@ func httpServer(addr string) error {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		w.Header().Set("Content-Type", page.contentType(r, content))
 		w.Write(content)
 	})
 	log.I("Starting server on", addr)
 	return http.ListenAndServe(addr, nil)
 }
 
+// checkSiteAuth checks the site-wide basic auth when it's required by the
+// site config, it writes the 401 response and returns false on failure.
+func checkSiteAuth(w http.ResponseWriter, r *http.Request) bool {
+	cfg := getSiteConfig()
+	if !cfg.Auth.Required {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	for _, u := range cfg.Auth.Users {
+		if checkBasicAuth(auth, u.Username, u.Password) {
+			return true
+		}
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", cfg.Auth.Realm))
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
 func checkBasicAuth(auth, username, password string) bool {
 	if !strings.HasPrefix(auth, "Basic ") {
 		return false
@@ -893,19 +1184,18 @@ func (n *node) renderLua(ctx context.Context) ([]byte, error) {
 		nodePath := L.CheckString(1)
 		content := L.CheckString(2)
 
-		absPath := filepath.Join(_rootDir, nodePath)
-
-		if err := os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+		absPath, err := resolveNodePath(nodePath)
+		if err != nil {
 			L.Push(lua.LBool(false))
 			L.Push(lua.LString(err.Error()))
 			return 2
 		}
-
-		if err := os.WriteFile(absPath, []byte(content), 0644); err != nil {
+		if err := writeNodeFile(absPath, []byte(content)); err != nil {
 			L.Push(lua.LBool(false))
 			L.Push(lua.LString(err.Error()))
 			return 2
 		}
+		commitChange(ctx, n, "Update "+nodePath, absPath)
 
 		L.Push(lua.LBool(true))
 		return 1
@@ -913,7 +1203,12 @@ func (n *node) renderLua(ctx context.Context) ([]byte, error) {
 
 	L.SetField(crewTable, "readNode", L.NewFunction(func(L *lua.LState) int {
 		nodePath := L.CheckString(1)
-		absPath := filepath.Join(_rootDir, nodePath)
+		absPath, err := resolveNodePath(nodePath)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
 
 		content, err := os.ReadFile(absPath)
 		if err != nil {
@@ -928,74 +1223,71 @@ func (n *node) renderLua(ctx context.Context) ([]byte, error) {
 
 	L.SetField(crewTable, "removeNode", L.NewFunction(func(L *lua.LState) int {
 		nodePath := L.CheckString(1)
-		absPath := filepath.Join(_rootDir, nodePath)
-
-		fileInfo, err := os.Stat(absPath)
+		absPath, err := resolveNodePath(nodePath)
 		if err != nil {
 			L.Push(lua.LBool(false))
 			L.Push(lua.LString(err.Error()))
 			return 2
 		}
 
-		if fileInfo.IsDir() {
-			// Read directory contents
-			entries, err := os.ReadDir(absPath)
-			if err != nil {
-				L.Push(lua.LBool(false))
-				L.Push(lua.LString(err.Error()))
-				return 2
-			}
-
-			// Check if directory is empty (ignoring hidden files and config files)
-			hasVisibleFiles := false
-			for _, entry := range entries {
-				if !isReservedName(entry.Name()) {
-					hasVisibleFiles = true
-					break
-				}
-			}
-
-			if hasVisibleFiles {
-				L.Push(lua.LBool(false))
-				L.Push(lua.LString("cannot remove non-empty directory"))
-				return 2
-			}
-
-			// Remove the empty directory and its config file
-			configPath := filepath.Join(absPath, ".conf.json")
-			if _, err := os.Stat(configPath); err == nil {
-				if err := os.Remove(configPath); err != nil {
-					L.Push(lua.LBool(false))
-					L.Push(lua.LString(fmt.Sprintf("failed to remove config file: %v", err)))
-					return 2
-				}
-			}
+		removed, err := removeNodeFile(absPath)
+		if len(removed) > 0 {
+			commitChange(ctx, n, "Remove "+nodePath, removed...)
+		}
+		if err != nil {
+			L.Push(lua.LBool(false))
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LBool(true))
+		return 1
+	}))
 
-			if err := os.Remove(absPath); err != nil {
-				L.Push(lua.LBool(false))
-				L.Push(lua.LString(fmt.Sprintf("failed to remove directory: %v", err)))
-				return 2
-			}
-		} else {
-			// Remove the file and its config file
-			if err := os.Remove(absPath); err != nil {
-				L.Push(lua.LBool(false))
-				L.Push(lua.LString(err.Error()))
-				return 2
-			}
+	// crew.search(q [, limit]) returns a list of {title, url, desc, snippet, score}
+	L.SetField(crewTable, "search", L.NewFunction(func(L *lua.LState) int {
+		q := L.CheckString(1)
+		limit := L.OptInt(2, searchLimit)
+
+		results := L.NewTable()
+		for _, res := range getSearchIndex().search(q, limit) {
+			item := L.NewTable()
+			L.SetField(item, "title", lua.LString(res.node.title))
+			L.SetField(item, "url", lua.LString(res.node.href()))
+			L.SetField(item, "desc", lua.LString(res.node.desc))
+			L.SetField(item, "snippet", lua.LString(res.snippet))
+			L.SetField(item, "score", lua.LNumber(res.score))
+			results.Append(item)
+		}
+		L.Push(results)
+		return 1
+	}))
 
-			// Try to remove the config file if it exists
-			configPath := absPath + ".conf.json"
-			if _, err := os.Stat(configPath); err == nil {
-				if err := os.Remove(configPath); err != nil {
-					L.Push(lua.LBool(false))
-					L.Push(lua.LString(fmt.Sprintf("file removed but failed to remove config file: %v", err)))
-					return 2
-				}
-			}
+	// crew.tags() returns a list of {name, url, count}, by name
+	L.SetField(crewTable, "tags", L.NewFunction(func(L *lua.LState) int {
+		results := L.NewTable()
+		for _, t := range getSiteIndex().allTags() {
+			item := L.NewTable()
+			L.SetField(item, "name", lua.LString(t.Name))
+			L.SetField(item, "url", lua.LString(t.URL))
+			L.SetField(item, "count", lua.LNumber(t.Count))
+			results.Append(item)
 		}
+		L.Push(results)
+		return 1
+	}))
 
-		L.Push(lua.LBool(true))
+	// crew.tagged(tag) returns a list of {title, url, desc} of the pages with the tag
+	L.SetField(crewTable, "tagged", L.NewFunction(func(L *lua.LState) int {
+		tag := L.CheckString(1)
+		results := L.NewTable()
+		for _, n := range getSiteIndex().tagged(tag) {
+			item := L.NewTable()
+			L.SetField(item, "title", lua.LString(n.title))
+			L.SetField(item, "url", lua.LString(n.href()))
+			L.SetField(item, "desc", lua.LString(n.desc))
+			results.Append(item)
+		}
+		L.Push(results)
 		return 1
 	}))
 
@@ -1058,6 +1350,11 @@ func (n *node) renderLua(ctx context.Context) ([]byte, error) {
 			}
 		}
 		L.SetField(reqTable, "query", queryTable)
+		if r.Method == geminiMethod {
+			// the answer to a Gemini input prompt is the whole query
+			input, _ := url.QueryUnescape(r.URL.RawQuery)
+			L.SetField(reqTable, "input", lua.LString(input))
+		}
 
 		// Add headers
 		headerTable := L.NewTable()
@@ -1093,6 +1390,8 @@ func (n *node) renderLua(ctx context.Context) ([]byte, error) {
 			fnName = "put"
 		case "DELETE":
 			fnName = "delete"
+		case geminiMethod:
+			fnName = "gemini"
 		default:
 			fnName = "render"
 		}
@@ -1102,7 +1401,11 @@ func (n *node) renderLua(ctx context.Context) ([]byte, error) {
 
 	fn := L.GetGlobal(fnName)
 	if fn.Type() != lua.LTFunction {
-		// Fallback to render if method-specific function not found
+		// Fallback to render if method-specific function not found, gemini
+		// has no fallback as render returns HTML
+		if fnName == "gemini" {
+			return nil, errNoGeminiFunc
+		}
 		if fnName != "render" {
 			fn = L.GetGlobal("render")
 			if fn.Type() != lua.LTFunction {
@@ -1149,9 +1452,55 @@ func (n *node) renderLua(ctx context.Context) ([]byte, error) {
 }
 
 func main() {
+	if err := setFlagsFromEnv(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+	flag.Parse()
 	if *printDefaultTpl {
 		fmt.Print(pageTpl)
 		return
 	}
-	log.Fatal(httpServer(*addr))
+	args := flag.Args()
+	if len(args) > 0 {
+		// crew config print [flags]
+		if len(args) < 2 || args[0] != "config" || args[1] != "print" {
+			fmt.Fprintf(os.Stderr, "unknown command: %s\n", strings.Join(args, " "))
+			os.Exit(2)
+		}
+		if err := flag.CommandLine.Parse(args[2:]); err != nil {
+			os.Exit(2)
+		}
+		cfg, err := loadSiteConfig(flag.CommandLine, *configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(cfg)
+		return
+	}
+	if err := reload(); err != nil {
+		log.Fatal(err)
+	}
+	go watchReload()
+	if err := initHistory(); err != nil {
+		log.Fatal(err)
+	}
+	rebuildSiteIndex()
+	getSearchIndex().build()
+	go watchTree()
+	if cfg := getSiteConfig().Gemini; cfg.Enabled {
+		go func() {
+			log.Fatal(geminiServer(cfg))
+		}()
+	}
+	if cfg := getSiteConfig().Gopher; cfg.Enabled {
+		go func() {
+			log.Fatal(gopherServer(cfg))
+		}()
+	}
+	if cfg := getSiteConfig().NineP; cfg.Enabled {
+		go func() {
+			log.Fatal(ninepServer(cfg))
+		}()
+	}
+	log.Fatal(httpServer(getSiteConfig().Addr))
 }
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/ast"
+	mdhtml "github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// tocMarker is replaced with the table of contents when it's alone in a
+// paragraph.
+const tocMarker = "<p>[TOC]</p>"
+
+// tocEntry is a heading of a markdown page, entries of deeper headings
+// are nested in Children.
+type tocEntry struct {
+	Level    int
+	ID       string
+	Title    string
+	Children []*tocEntry
+}
+
+// tocTpl lets templates render page.TOC with {{ template "toc" .TOC }}.
+const tocTpl = `{{ define "toc" }}<ul>{{ range . }}<li><a href="#{{ .ID | html }}">{{ .Title | html }}</a>{{ if .Children }}{{ template "toc" .Children }}{{ end }}</li>{{ end }}</ul>{{ end }}`
+
+// markdownProfileSafe is the profile for untrusted content: raw HTML is
+// escaped and links are limited to safe protocols with rel="nofollow". It
+// sticks to the whole subtree, a deeper .conf.json can't turn it off.
+const markdownProfileSafe = "safe"
+
+// unsafeExtensions write text of the page into HTML attributes as is, they
+// are off in the safe profile whatever the .conf.json files say.
+const unsafeExtensions = parser.HeadingIDs | parser.Attributes | parser.Mmark
+
+// markdownConfig is the "markdown" section of the site config and of
+// .conf.json. Extensions and Flags are names from markdownExtensions and
+// markdownFlags, added to the defaults, or removed with a "-" prefix.
+type markdownConfig struct {
+	Profile    string   `json:"profile"`
+	Extensions []string `json:"extensions"`
+	Flags      []string `json:"flags"`
+}
+
+var markdownExtensions = map[string]parser.Extensions{
+	"no_intra_emphasis":          parser.NoIntraEmphasis,
+	"tables":                     parser.Tables,
+	"fenced_code":                parser.FencedCode,
+	"autolink":                   parser.Autolink,
+	"strikethrough":              parser.Strikethrough,
+	"lax_html_blocks":            parser.LaxHTMLBlocks,
+	"space_headings":             parser.SpaceHeadings,
+	"hard_line_break":            parser.HardLineBreak,
+	"non_blocking_space":         parser.NonBlockingSpace,
+	"tab_size_eight":             parser.TabSizeEight,
+	"footnotes":                  parser.Footnotes,
+	"no_empty_line_before_block": parser.NoEmptyLineBeforeBlock,
+	"heading_ids":                parser.HeadingIDs,
+	"titleblock":                 parser.Titleblock,
+	"auto_heading_ids":           parser.AutoHeadingIDs,
+	"backslash_line_break":       parser.BackslashLineBreak,
+	"definition_lists":           parser.DefinitionLists,
+	"mathjax":                    parser.MathJax,
+	"ordered_list_start":         parser.OrderedListStart,
+	"attributes":                 parser.Attributes,
+	"super_subscript":            parser.SuperSubscript,
+	"empty_lines_break_list":     parser.EmptyLinesBreakList,
+	"mmark":                      parser.Mmark,
+}
+
+var markdownFlags = map[string]mdhtml.Flags{
+	"skip_html":                 mdhtml.SkipHTML,
+	"skip_images":               mdhtml.SkipImages,
+	"skip_links":                mdhtml.SkipLinks,
+	"safelink":                  mdhtml.Safelink,
+	"nofollow_links":            mdhtml.NofollowLinks,
+	"noreferrer_links":          mdhtml.NoreferrerLinks,
+	"noopener_links":            mdhtml.NoopenerLinks,
+	"href_target_blank":         mdhtml.HrefTargetBlank,
+	"footnote_return_links":     mdhtml.FootnoteReturnLinks,
+	"footnote_no_hr_tag":        mdhtml.FootnoteNoHRTag,
+	"smartypants":               mdhtml.Smartypants,
+	"smartypants_fractions":     mdhtml.SmartypantsFractions,
+	"smartypants_dashes":        mdhtml.SmartypantsDashes,
+	"smartypants_latex_dashes":  mdhtml.SmartypantsLatexDashes,
+	"smartypants_angled_quotes": mdhtml.SmartypantsAngledQuotes,
+	"smartypants_quotes_nbsp":   mdhtml.SmartypantsQuotesNBSP,
+	"lazy_load_images":          mdhtml.LazyLoadImages,
+}
+
+// markdownOptions are the effective parser and renderer settings for a page.
+type markdownOptions struct {
+	extensions parser.Extensions
+	flags      mdhtml.Flags
+	safe       bool
+}
+
+func defaultMarkdownOptions() *markdownOptions {
+	return &markdownOptions{
+		extensions: parser.CommonExtensions | parser.AutoHeadingIDs,
+		flags:      mdhtml.CommonFlags,
+	}
+}
+
+// toggle splits a "-name" into (false, "name").
+func toggle(name string) (bool, string) {
+	if strings.HasPrefix(name, "-") {
+		return false, name[1:]
+	}
+	return true, name
+}
+
+func (o *markdownOptions) apply(c *markdownConfig) error {
+	if c == nil {
+		return nil
+	}
+	switch c.Profile {
+	case "", "default":
+	case markdownProfileSafe:
+		o.safe = true
+	default:
+		return fmt.Errorf("unknown markdown profile: %s", c.Profile)
+	}
+	for _, name := range c.Extensions {
+		on, name := toggle(name)
+		ext, ok := markdownExtensions[name]
+		if !ok {
+			return fmt.Errorf("unknown markdown extension: %s", name)
+		}
+		if on {
+			o.extensions |= ext
+		} else {
+			o.extensions &^= ext
+		}
+	}
+	for _, name := range c.Flags {
+		on, name := toggle(name)
+		flag, ok := markdownFlags[name]
+		if !ok {
+			return fmt.Errorf("unknown markdown flag: %s", name)
+		}
+		if on {
+			o.flags |= flag
+		} else {
+			o.flags &^= flag
+		}
+	}
+	return nil
+}
+
+// markdownOptions returns the markdown settings for the node: the site
+// config, then the .conf.json of every directory from the root down to the
+// node itself.
+func (n *node) markdownOptions() (*markdownOptions, error) {
+	opts := defaultMarkdownOptions()
+	if err := opts.apply(getSiteConfig().Markdown); err != nil {
+		return nil, err
+	}
+	var chain []*node
+	for cur := n; cur != nil; cur, _ = cur.getParentNode() {
+		chain = append(chain, cur)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		if err := opts.apply(chain[i].markdown); err != nil {
+			return nil, fmt.Errorf("%s: %w", chain[i].filepath, err)
+		}
+	}
+	if opts.safe {
+		opts.flags |= mdhtml.NofollowLinks
+		opts.extensions &^= unsafeExtensions
+	}
+	return opts, nil
+}
+
+func (o *markdownOptions) newParser() *parser.Parser {
+	return parser.NewWithExtensions(o.extensions)
+}
+
+// safeSchemes are the link protocols allowed in the safe profile.
+var safeSchemes = []string{"http:", "https:", "mailto:", "ftp:"}
+
+// isSafeLink reports whether a link is relative or uses a safe protocol.
+func isSafeLink(dest []byte) bool {
+	s := strings.ToLower(strings.TrimSpace(string(dest)))
+	colon := strings.IndexByte(s, ':')
+	if colon < 0 || strings.ContainsAny(s[:colon], "/?#") {
+		return true
+	}
+	for _, scheme := range safeSchemes {
+		if strings.HasPrefix(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// renderHook adds a permalink anchor at the end of every heading,
+// highlights fenced code blocks, and in the safe profile escapes raw HTML
+// and drops links with unsafe protocols (keeping their text).
+func (o *markdownOptions) renderHook(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	switch node := node.(type) {
+	case *ast.Heading:
+		if !entering && node.HeadingID != "" {
+			fmt.Fprintf(w, ` <a class="permalink" href="#%s" aria-label="permalink">#</a>`, html.EscapeString(node.HeadingID))
+		}
+	case *ast.CodeBlock:
+		if node.IsFenced && !getSiteConfig().Highlight.Disabled {
+			if err := highlightCode(w, string(node.Literal), codeLang(node.Info)); err == nil {
+				return ast.GoToNext, true
+			}
+		}
+	case *ast.HTMLBlock:
+		if o.safe && strings.TrimSpace(string(node.Literal)) == moreMarker {
+			// keep the excerpt marker of blog posts, it's a comment
+			io.WriteString(w, moreMarker+"\n")
+			return ast.GoToNext, true
+		}
+		if o.safe {
+			io.WriteString(w, "<p>"+html.EscapeString(string(node.Literal))+"</p>\n")
+			return ast.GoToNext, true
+		}
+	case *ast.HTMLSpan:
+		if o.safe && string(node.Literal) == moreMarker {
+			io.WriteString(w, moreMarker)
+			return ast.GoToNext, true
+		}
+		if o.safe {
+			io.WriteString(w, html.EscapeString(string(node.Literal)))
+			return ast.GoToNext, true
+		}
+	case *ast.Link:
+		if o.safe && node.NoteID == 0 && !isSafeLink(node.Destination) {
+			return ast.GoToNext, true
+		}
+	case *ast.Image:
+		if o.safe && !isSafeLink(node.Destination) {
+			return ast.SkipChildren, true
+		}
+	}
+	return ast.GoToNext, false
+}
+
+func (n *node) renderMarkdown(ctx context.Context) ([]byte, error) {
+	content, err := os.ReadFile(n.filepath)
+	if err != nil {
+		return nil, err
+	}
+	return n.renderMarkdownContent(ctx, content)
+}
+
+// renderMarkdownContent renders content as the markdown of the node, e.g.
+// an unsaved draft.
+func (n *node) renderMarkdownContent(ctx context.Context, content []byte) ([]byte, error) {
+	doc, opts, err := n.parseMarkdown(content)
+	if err != nil {
+		return nil, err
+	}
+	return n.renderMarkdownDoc(ctx, doc, opts), nil
+}
+
+// parseMarkdown parses content as the markdown of the node.
+func (n *node) parseMarkdown(content []byte) (ast.Node, *markdownOptions, error) {
+	opts, err := n.markdownOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+	p := opts.newParser()
+	registerWikiLinks(p, getSiteIndex(), n, nil)
+	doc := markdown.Parse(stripFrontMatter(content), p)
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if h, ok := node.(*ast.Heading); ok && entering {
+			h.HeadingID = headingID(h.HeadingID)
+		}
+		return ast.GoToNext
+	})
+	return doc, opts, nil
+}
+
+// headingID keeps the letters, digits, '-' and '_' of a heading id, the
+// renderer writes it in an attribute without escaping it.
+func headingID(id string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, id)
+}
+
+// renderMarkdownDoc renders a parsed document of the node to html.
+func (n *node) renderMarkdownDoc(ctx context.Context, doc ast.Node, opts *markdownOptions) []byte {
+	renderer := mdhtml.NewRenderer(mdhtml.RendererOptions{
+		Flags:          opts.flags,
+		RenderNodeHook: opts.renderHook,
+	})
+	output := markdown.Render(doc, renderer)
+
+	toc := buildTOC(doc)
+	if pg, ok := ctx.Value("page").(*page); ok {
+		pg.TOC = toc
+	}
+	if bytes.Contains(output, []byte(tocMarker)) {
+		output = bytes.Replace(output, []byte(tocMarker), []byte(renderTOC(toc)), 1)
+	} else if n.toc && len(toc) > 0 {
+		output = append([]byte(renderTOC(toc)), output...)
+	}
+	return output
+}
+
+// headingText returns the plain text of a heading.
+func headingText(h *ast.Heading) string {
+	var sb strings.Builder
+	ast.WalkFunc(h, func(node ast.Node, entering bool) ast.WalkStatus {
+		if leaf := node.AsLeaf(); leaf != nil && entering {
+			sb.Write(leaf.Literal)
+		}
+		return ast.GoToNext
+	})
+	return sb.String()
+}
+
+// buildTOC collects the headings of a markdown document into a tree.
+func buildTOC(doc ast.Node) []*tocEntry {
+	var (
+		root  []*tocEntry
+		stack []*tocEntry
+	)
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		h, ok := node.(*ast.Heading)
+		if !ok || !entering || h.IsTitleblock || h.HeadingID == "" {
+			return ast.GoToNext
+		}
+		e := &tocEntry{Level: h.Level, ID: h.HeadingID, Title: headingText(h)}
+		for len(stack) > 0 && stack[len(stack)-1].Level >= e.Level {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			root = append(root, e)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, e)
+		}
+		stack = append(stack, e)
+		return ast.SkipChildren
+	})
+	return root
+}
+
+func renderTOC(toc []*tocEntry) string {
+	var buf bytes.Buffer
+	buf.WriteString(`<nav class="toc">`)
+	writeTOC(&buf, toc)
+	buf.WriteString(`</nav>`)
+	return buf.String()
+}
+
+func writeTOC(buf *bytes.Buffer, toc []*tocEntry) {
+	buf.WriteString("<ul>")
+	for _, e := range toc {
+		buf.WriteString(`<li><a href="#` + html.EscapeString(e.ID) + `">` + html.EscapeString(e.Title) + "</a>")
+		if len(e.Children) > 0 {
+			writeTOC(buf, e.Children)
+		}
+		buf.WriteString("</li>")
+	}
+	buf.WriteString("</ul>")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMarkdownHeadingIDs(t *testing.T) {
+	const attack = `x" onmouseover="alert(1)`
+	tests := []struct {
+		name    string
+		profile string
+		content string
+		// want are in the output, unwanted aren't
+		want, unwanted []string
+	}{
+		{
+			name:     "safe profile ignores explicit ids",
+			profile:  markdownProfileSafe,
+			content:  "[TOC]\n\n# Hi {#" + attack + "}\n",
+			unwanted: []string{"onmouseover=\"", `id="x"`},
+		},
+		{
+			name:     "safe profile ignores attributes",
+			profile:  markdownProfileSafe,
+			content:  "{#" + attack + "}\n# Hi\n",
+			unwanted: []string{"onmouseover=\""},
+		},
+		{
+			name:     "explicit ids are restricted",
+			content:  "[TOC]\n\n# Hi {#" + attack + "}\n",
+			want:     []string{`id="x--onmouseover--alert-1-"`, `href="#x--onmouseover--alert-1-"`},
+			unwanted: []string{"onmouseover=\""},
+		},
+		{
+			name:    "automatic ids keep letters",
+			content: "# Grüße 你好\n",
+			want:    []string{`id="grüße-你好"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultSiteConfig()
+			if tt.profile != "" {
+				cfg.Markdown = &markdownConfig{Profile: tt.profile, Extensions: []string{"heading_ids", "attributes"}}
+			}
+			root := newTestSite(t, cfg, map[string]string{"a.md": tt.content})
+			n, err := newNodeFromPath(filepath.Join(root, "a.md"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := n.renderMarkdown(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tt.want {
+				if !strings.Contains(string(out), s) {
+					t.Errorf("%s not in\n%s", s, out)
+				}
+			}
+			for _, s := range tt.unwanted {
+				if strings.Contains(string(out), s) {
+					t.Errorf("%s in\n%s", s, out)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path"
+)
+
+// breadcrumbs returns the links from the root down to the parent of the
+// node, using the titles from their conf.
+func (n *node) breadcrumbs() []pageLink {
+	var crumbs []pageLink
+	for cur, _ := n.getParentNode(); cur != nil; cur, _ = cur.getParentNode() {
+		l := linkTo(cur)
+		if path.Clean(cur.filepath) == path.Clean(_rootDir) {
+			l.Title = getSiteConfig().SiteName
+		}
+		crumbs = append([]pageLink{l}, crumbs...)
+	}
+	return crumbs
+}
+
+// siblings returns the previous and next nodes in the side nav, i.e. the
+// nodes around n in its directory's sort order skipping hidden ones, nil
+// at either end.
+func (n *node) siblings() (prev, next *pageLink) {
+	parent, err := n.getParentNode()
+	if err != nil || parent == nil {
+		return nil, nil
+	}
+	subnodes, err := parent.getSubNodes()
+	if err != nil {
+		return nil, nil
+	}
+	subnodes = filterNode(subnodes, func(s *node) bool {
+		return !s.isHidden || path.Clean(s.filepath) == path.Clean(n.filepath)
+	})
+	for i, s := range subnodes {
+		if path.Clean(s.filepath) != path.Clean(n.filepath) {
+			continue
+		}
+		if i > 0 {
+			l := linkTo(subnodes[i-1])
+			prev = &l
+		}
+		if i < len(subnodes)-1 {
+			l := linkTo(subnodes[i+1])
+			next = &l
+		}
+		break
+	}
+	return prev, next
+}
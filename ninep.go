@@ -0,0 +1,770 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/c4pt0r/log"
+)
+
+// A minimal 9P2000 file server: each node is a directory holding raw, html,
+// conf and title files, and the nodes below it for directories.
+//
+// The protocol is written out here rather than taken from a library: crew
+// needs a dozen messages of plain 9P2000, which Plan 9, plan9port and the
+// Linux v9fs client all speak. github.com/docker/go-p9p implements the same
+// dialect and could replace the codec below once it is added to go.mod.
+// ninep_test.go drives the server with a client of its own.
+
+const (
+	defaultNinePAddr = "localhost:5640"
+	ninepVersion     = "9P2000"
+	ninepMaxMsize    = 64 << 10
+	// ninepIOHeader is the size of the header of Rread and Twrite
+	ninepIOHeader = 24
+	ninepNoFid    = ^uint32(0)
+	ninepUser     = "crew"
+	// ninepMaxAuth bounds the password written to an auth fid
+	ninepMaxAuth = 1 << 10
+)
+
+// message types
+const (
+	tVersion = 100 + iota*2
+	tAuth
+	tAttach
+	tError // there is no Terror, Rerror is 107
+	tFlush
+	tWalk
+	tOpen
+	tCreate
+	tRead
+	tWrite
+	tClunk
+	tRemove
+	tStat
+	tWstat
+)
+
+const (
+	qtDir  = 0x80
+	qtAuth = 0x08
+	dmDir  = 0x80000000
+	oTrunc = 0x10
+)
+
+var (
+	errNinePNotFound = errors.New("file does not exist")
+	errNinePPerm     = errors.New("permission denied")
+	errNinePBadFid   = errors.New("unknown fid")
+	errNinePFidInUse = errors.New("fid already in use")
+	errNinePNotOpen  = errors.New("file not open")
+	errNinePBadMsg   = errors.New("bad message")
+	errNinePAuth     = errors.New("authentication failed")
+)
+
+// ninepFiles are the files of a node directory.
+var ninepFiles = []string{"raw", "html", "conf", "title"}
+
+// ninepConfig is the "9p" section of the site config.
+type ninepConfig struct {
+	Enabled bool `json:"enabled"`
+	// Addr is host:port to listen on TCP, or unix:/path/to/socket
+	Addr string `json:"addr"`
+}
+
+// ninepServer serves the node tree over 9P.
+func ninepServer(cfg ninepConfig) error {
+	network, addr := "tcp", cfg.Addr
+	if addr == "" {
+		addr = defaultNinePAddr
+	}
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+		os.Remove(addr)
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	log.I("Starting 9P server on", network, addr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go newNinePConn(conn).serve()
+	}
+}
+
+// ninepFid is the file a fid of a connection points to.
+type ninepFid struct {
+	// fpath is the file or directory of the node
+	fpath string
+	// file is one of ninepFiles, "" for the node directory
+	file string
+	// user is the site user the fid was attached as, "" for anonymous
+	user string
+
+	// auth fids get the password of authUser written to them
+	auth     bool
+	authUser string
+	authPass []byte
+
+	open  bool
+	write bool
+	// data is the content of an open file, as written so far for raw
+	data  []byte
+	dirty bool
+	// dir holds the entries of an open directory, dirOff the offset of the
+	// next read
+	dir    [][]byte
+	dirOff uint64
+}
+
+func (f *ninepFid) isDir() bool {
+	return f.file == "" && !f.auth
+}
+
+type ninepConn struct {
+	conn  net.Conn
+	msize uint32
+	fids  map[uint32]*ninepFid
+}
+
+func newNinePConn(conn net.Conn) *ninepConn {
+	return &ninepConn{conn: conn, msize: ninepMaxMsize, fids: map[uint32]*ninepFid{}}
+}
+
+// serve answers the messages of the connection one at a time.
+func (c *ninepConn) serve() {
+	defer c.conn.Close()
+	defer c.clunkAll()
+	r := bufio.NewReader(c.conn)
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return
+		}
+		if size < 7 || size > c.msize {
+			log.E("9p: bad message size", size)
+			return
+		}
+		msg := make([]byte, size-4)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return
+		}
+		typ, tag := msg[0], binary.LittleEndian.Uint16(msg[1:3])
+		resp, err := c.handle(typ, &ninepDec{b: msg[3:]})
+		if err != nil {
+			typ, resp = tError, appendString(nil, err.Error())
+		}
+		out := binary.LittleEndian.AppendUint32(nil, uint32(7+len(resp)))
+		out = append(out, typ+1)
+		out = binary.LittleEndian.AppendUint16(out, tag)
+		if _, err := c.conn.Write(append(out, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+func (c *ninepConn) handle(typ uint8, d *ninepDec) ([]byte, error) {
+	switch typ {
+	case tVersion:
+		msize, version := d.u32(), d.str()
+		if d.err != nil || msize <= ninepIOHeader {
+			return nil, errNinePBadMsg
+		}
+		c.msize = min(msize, ninepMaxMsize)
+		c.clunkAll()
+		if !strings.HasPrefix(version, ninepVersion) {
+			version = "unknown"
+		} else {
+			version = ninepVersion
+		}
+		return appendString(binary.LittleEndian.AppendUint32(nil, c.msize), version), nil
+	case tAuth:
+		afid, uname, _ := d.u32(), d.str(), d.str()
+		if d.err != nil {
+			return nil, errNinePBadMsg
+		}
+		if _, ok := c.fids[afid]; ok {
+			return nil, errNinePFidInUse
+		}
+		c.fids[afid] = &ninepFid{auth: true, authUser: uname}
+		return appendQid(nil, qtAuth, 0, ninepQidPath("auth", uname)), nil
+	case tAttach:
+		return c.attach(d)
+	case tFlush:
+		// messages are answered in order, there's never one to flush
+		return nil, nil
+	case tWalk:
+		return c.walk(d)
+	case tOpen:
+		fid, mode := d.u32(), d.u8()
+		if d.err != nil {
+			return nil, errNinePBadMsg
+		}
+		return c.open(fid, mode)
+	case tCreate:
+		return nil, errNinePPerm
+	case tRead:
+		fid, offset, count := d.u32(), d.u64(), d.u32()
+		if d.err != nil {
+			return nil, errNinePBadMsg
+		}
+		return c.read(fid, offset, count)
+	case tWrite:
+		fid, offset, count := d.u32(), d.u64(), d.u32()
+		data := d.bytes(int(count))
+		if d.err != nil {
+			return nil, errNinePBadMsg
+		}
+		return c.write(fid, offset, data)
+	case tClunk, tRemove:
+		fid := d.u32()
+		f, ok := c.fids[fid]
+		if !ok {
+			return nil, errNinePBadFid
+		}
+		delete(c.fids, fid)
+		if err := c.clunk(f); err != nil {
+			return nil, err
+		}
+		if typ == tRemove {
+			return nil, errNinePPerm
+		}
+		return nil, nil
+	case tStat:
+		f, ok := c.fids[d.u32()]
+		if !ok {
+			return nil, errNinePBadFid
+		}
+		stat, err := ninepStat(f)
+		if err != nil {
+			return nil, err
+		}
+		return append(binary.LittleEndian.AppendUint16(nil, uint16(len(stat))), stat...), nil
+	case tWstat:
+		return c.wstat(d)
+	}
+	return nil, errNinePBadMsg
+}
+
+// attach checks the password written to the auth fid, if any. Anonymous
+// attaches can read the site unless auth is required, writing needs a user
+// with write permission. Like the nodes below it, the root can't be served
+// when it's protected.
+func (c *ninepConn) attach(d *ninepDec) ([]byte, error) {
+	fid, afid, uname, _ := d.u32(), d.u32(), d.str(), d.str()
+	if d.err != nil {
+		return nil, errNinePBadMsg
+	}
+	if _, ok := c.fids[fid]; ok {
+		return nil, errNinePFidInUse
+	}
+	user := ""
+	if afid != ninepNoFid {
+		af, ok := c.fids[afid]
+		if !ok || !af.auth || af.authUser != uname {
+			return nil, errNinePAuth
+		}
+		u, ok := siteUserByPassword(uname, strings.TrimSpace(string(af.authPass)))
+		if !ok {
+			return nil, errNinePAuth
+		}
+		user = u.Username
+	} else if getSiteConfig().Auth.Required {
+		return nil, errNinePAuth
+	}
+	if root, err := newNodeFromPath(_rootDir); err != nil || !isPublic(root) {
+		return nil, errNinePPerm
+	}
+	f := &ninepFid{fpath: filepath.Clean(_rootDir), user: user}
+	c.fids[fid] = f
+	return ninepQid(f)
+}
+
+// siteUserByPassword returns the site user with the name and password.
+func siteUserByPassword(name, password string) (siteUser, bool) {
+	for _, u := range getSiteConfig().Auth.Users {
+		if u.Username == name && u.Password == password && name != "" {
+			return u, true
+		}
+	}
+	return siteUser{}, false
+}
+
+func (c *ninepConn) walk(d *ninepDec) ([]byte, error) {
+	fid, newfid, nwname := d.u32(), d.u32(), d.u16()
+	names := make([]string, nwname)
+	for i := range names {
+		names[i] = d.str()
+	}
+	if d.err != nil || nwname > 16 {
+		return nil, errNinePBadMsg
+	}
+	f, ok := c.fids[fid]
+	if !ok {
+		return nil, errNinePBadFid
+	}
+	if f.open || f.auth {
+		return nil, errNinePPerm
+	}
+	if _, ok := c.fids[newfid]; ok && newfid != fid {
+		return nil, errNinePFidInUse
+	}
+	cur := &ninepFid{fpath: f.fpath, file: f.file, user: f.user}
+	var qids []byte
+	for i, name := range names {
+		next, err := ninepWalk1(cur, name)
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			// a partial walk returns the qids walked, newfid is unchanged
+			return append(binary.LittleEndian.AppendUint16(nil, uint16(i)), qids...), nil
+		}
+		cur = next
+		qid, err := ninepQid(cur)
+		if err != nil {
+			return nil, err
+		}
+		qids = append(qids, qid...)
+	}
+	c.fids[newfid] = cur
+	return append(binary.LittleEndian.AppendUint16(nil, nwname), qids...), nil
+}
+
+// ninepWalk1 walks to a file of the node, a child node or the parent.
+func ninepWalk1(f *ninepFid, name string) (*ninepFid, error) {
+	if !f.isDir() {
+		return nil, errNinePNotFound
+	}
+	next := &ninepFid{fpath: f.fpath, user: f.user}
+	switch {
+	case name == "..":
+		if f.fpath != filepath.Clean(_rootDir) {
+			next.fpath = filepath.Dir(f.fpath)
+		}
+		return next, nil
+	case isNinePFile(name):
+		next.file = name
+		return next, nil
+	}
+	info, err := os.Stat(f.fpath)
+	if err != nil || !info.IsDir() || name == "." || strings.Contains(name, "/") || isReservedName(name) {
+		return nil, errNinePNotFound
+	}
+	next.fpath = filepath.Join(f.fpath, name)
+	n, err := newNodeFromPath(next.fpath)
+	if err != nil || !isPublic(n) {
+		return nil, errNinePNotFound
+	}
+	return next, nil
+}
+
+func isNinePFile(name string) bool {
+	for _, f := range ninepFiles {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ninepConn) open(fid uint32, mode uint8) ([]byte, error) {
+	f, ok := c.fids[fid]
+	if !ok {
+		return nil, errNinePBadFid
+	}
+	if f.open {
+		return nil, errNinePPerm
+	}
+	write := mode&3 == 1 || mode&3 == 2
+	n, err := newNodeFromPath(f.fpath)
+	if err != nil {
+		return nil, errNinePNotFound
+	}
+	switch {
+	case f.auth:
+	case f.isDir():
+		if write || mode&oTrunc != 0 {
+			return nil, errNinePPerm
+		}
+		subnodes, err := n.getSubNodes()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range ninepFiles {
+			stat, err := ninepStat(&ninepFid{fpath: f.fpath, file: name})
+			if err != nil {
+				return nil, err
+			}
+			f.dir = append(f.dir, stat)
+		}
+		for _, sub := range subnodes {
+			if sub.isHidden || !isPublic(sub) {
+				continue
+			}
+			stat, err := ninepStat(&ninepFid{fpath: sub.filepath})
+			if err != nil {
+				return nil, err
+			}
+			f.dir = append(f.dir, stat)
+		}
+	default:
+		if write && !ninepCanWrite(f, n) {
+			return nil, errNinePPerm
+		}
+		if mode&oTrunc == 0 || !write {
+			if f.data, err = ninepData(n, f.file); err != nil {
+				return nil, err
+			}
+		} else {
+			f.dirty = true
+		}
+	}
+	f.open, f.write = true, write
+	qid, err := ninepQid(f)
+	if err != nil {
+		return nil, err
+	}
+	return binary.LittleEndian.AppendUint32(qid, 0), nil
+}
+
+// ninepCanWrite reports whether the fid may write the file: only the raw
+// file of pages, by users allowed to edit them on the web.
+func ninepCanWrite(f *ninepFid, n *node) bool {
+	if f.file != "raw" || !n.isEditable() {
+		return false
+	}
+	for _, u := range getSiteConfig().Auth.Users {
+		if u.Username == f.user && u.Write {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ninepConn) read(fid uint32, offset uint64, count uint32) ([]byte, error) {
+	f, ok := c.fids[fid]
+	if !ok {
+		return nil, errNinePBadFid
+	}
+	if !f.open && !f.auth {
+		return nil, errNinePNotOpen
+	}
+	count = min(count, c.msize-ninepIOHeader)
+	var data []byte
+	if f.isDir() {
+		// directories are read from the start or where the last read stopped
+		if offset == 0 {
+			f.dirOff = 0
+		} else if offset != f.dirOff {
+			return nil, errNinePBadMsg
+		}
+		for len(f.dir) > 0 && len(data)+len(f.dir[0]) <= int(count) {
+			data = append(data, f.dir[0]...)
+			f.dir = f.dir[1:]
+		}
+		f.dirOff += uint64(len(data))
+	} else if !f.auth && offset < uint64(len(f.data)) {
+		data = f.data[offset:min(offset+uint64(count), uint64(len(f.data)))]
+	}
+	return append(binary.LittleEndian.AppendUint32(nil, uint32(len(data))), data...), nil
+}
+
+func (c *ninepConn) write(fid uint32, offset uint64, data []byte) ([]byte, error) {
+	f, ok := c.fids[fid]
+	if !ok {
+		return nil, errNinePBadFid
+	}
+	switch {
+	case f.auth:
+		if len(f.authPass)+len(data) > ninepMaxAuth {
+			return nil, errNinePAuth
+		}
+		f.authPass = append(f.authPass, data...)
+	case !f.open || !f.write:
+		return nil, errNinePPerm
+	default:
+		if offset > maxEditSize || uint64(len(data)) > maxEditSize-offset {
+			return nil, errors.New("file too large")
+		}
+		if end := offset + uint64(len(data)); end > uint64(len(f.data)) {
+			f.data = append(f.data, make([]byte, end-uint64(len(f.data)))...)
+		}
+		copy(f.data[offset:], data)
+		f.dirty = true
+	}
+	return binary.LittleEndian.AppendUint32(nil, uint32(len(data))), nil
+}
+
+// wstat only supports truncating raw, other changes are ignored so that
+// tools setting times or modes keep working, renames are refused.
+func (c *ninepConn) wstat(d *ninepDec) ([]byte, error) {
+	fid := d.u32()
+	d.u16() // size of the stat
+	d.u16() // size of the entry
+	d.u16() // type
+	d.u32() // dev
+	d.bytes(13)
+	d.u32() // mode
+	d.u32() // atime
+	d.u32() // mtime
+	length, name := d.u64(), d.str()
+	if d.err != nil {
+		return nil, errNinePBadMsg
+	}
+	f, ok := c.fids[fid]
+	if !ok {
+		return nil, errNinePBadFid
+	}
+	if name != "" {
+		return nil, errNinePPerm
+	}
+	if length == ^uint64(0) {
+		return nil, nil
+	}
+	n, err := newNodeFromPath(f.fpath)
+	if err != nil || f.isDir() || !ninepCanWrite(f, n) {
+		return nil, errNinePPerm
+	}
+	data, err := ninepData(n, "raw")
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(len(data)) {
+		return nil, errNinePPerm
+	}
+	if err := ninepSave(f.user, n, data[:length]); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// clunk saves the raw file written through the fid.
+func (c *ninepConn) clunk(f *ninepFid) error {
+	if !f.dirty {
+		return nil
+	}
+	n, err := newNodeFromPath(f.fpath)
+	if err != nil {
+		return err
+	}
+	return ninepSave(f.user, n, f.data)
+}
+
+func (c *ninepConn) clunkAll() {
+	for fid, f := range c.fids {
+		if err := c.clunk(f); err != nil {
+			log.E(err)
+		}
+		delete(c.fids, fid)
+	}
+}
+
+// ninepSave saves the page like the web editor, and has the indexes updated.
+func ninepSave(user string, n *node, content []byte) error {
+	contentFile, _, err := n.editFiles()
+	if err != nil {
+		return err
+	}
+	if err := saveEdit(user, contentFile, content); err != nil {
+		return err
+	}
+	invalidateTree(contentFile)
+	return nil
+}
+
+// ninepData returns the content of a file of a node.
+func ninepData(n *node, file string) ([]byte, error) {
+	switch file {
+	case "raw":
+		contentFile := n.contentFile()
+		if contentFile == "" {
+			return nil, nil
+		}
+		return os.ReadFile(contentFile)
+	case "html":
+		return n.Render(context.Background())
+	case "conf":
+		_, conf, err := getConfigFileForFile(n.filepath)
+		if err != nil {
+			return nil, err
+		}
+		return ninepConf(conf)
+	case "title":
+		return []byte(n.title + "\n"), nil
+	}
+	return nil, errNinePNotFound
+}
+
+// ninepConf returns the .conf.json as it is, or re-encoded without its
+// secretConfFields when it has any.
+func ninepConf(confFile string) ([]byte, error) {
+	m, err := readConfMap(confFile)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	secret := false
+	for _, k := range secretConfFields {
+		if _, ok := m[k]; ok {
+			secret = true
+			delete(m, k)
+		}
+	}
+	if !secret {
+		return readOptional(confFile)
+	}
+	if len(m) == 0 {
+		return nil, nil
+	}
+	data, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func ninepQidPath(fpath, file string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(fpath + "\x00" + file))
+	return h.Sum64()
+}
+
+func ninepQid(f *ninepFid) ([]byte, error) {
+	if f.auth {
+		return appendQid(nil, qtAuth, 0, ninepQidPath("auth", f.authUser)), nil
+	}
+	info, err := os.Stat(f.fpath)
+	if err != nil {
+		return nil, errNinePNotFound
+	}
+	typ := uint8(0)
+	if f.isDir() {
+		typ = qtDir
+	}
+	return appendQid(nil, typ, uint32(info.ModTime().Unix()), ninepQidPath(f.fpath, f.file)), nil
+}
+
+func appendQid(b []byte, typ uint8, version uint32, path uint64) []byte {
+	b = append(b, typ)
+	b = binary.LittleEndian.AppendUint32(b, version)
+	return binary.LittleEndian.AppendUint64(b, path)
+}
+
+// ninepStat returns the stat entry of the file of a fid. The length of html
+// is 0 as it's only rendered when read.
+func ninepStat(f *ninepFid) ([]byte, error) {
+	n, err := newNodeFromPath(f.fpath)
+	if err != nil {
+		return nil, errNinePNotFound
+	}
+	qid, err := ninepQid(f)
+	if err != nil {
+		return nil, err
+	}
+	name, mode, mtime, length := f.file, uint32(0444), n.modTime, 0
+	switch {
+	case f.isDir():
+		name, mode = filepath.Base(f.fpath), dmDir|0555
+		if f.fpath == filepath.Clean(_rootDir) {
+			name = "/"
+		}
+	case f.file == "raw":
+		if n.isEditable() {
+			mode = 0664
+		}
+		if contentFile := n.contentFile(); contentFile != "" {
+			if info, err := os.Stat(contentFile); err == nil {
+				mtime, length = info.ModTime(), int(info.Size())
+			}
+		}
+	case f.file == "conf", f.file == "title":
+		data, err := ninepData(n, f.file)
+		if err != nil {
+			return nil, err
+		}
+		length = len(data)
+	}
+	return appendStat(qid, name, mode, mtime, uint64(length)), nil
+}
+
+func appendStat(qid []byte, name string, mode uint32, mtime time.Time, length uint64) []byte {
+	b := binary.LittleEndian.AppendUint16(nil, 0) // type
+	b = binary.LittleEndian.AppendUint32(b, 0)    // dev
+	b = append(b, qid...)
+	b = binary.LittleEndian.AppendUint32(b, mode)
+	b = binary.LittleEndian.AppendUint32(b, uint32(mtime.Unix())) // atime
+	b = binary.LittleEndian.AppendUint32(b, uint32(mtime.Unix()))
+	b = binary.LittleEndian.AppendUint64(b, length)
+	for _, s := range []string{name, ninepUser, ninepUser, ninepUser} {
+		b = appendString(b, s)
+	}
+	return append(binary.LittleEndian.AppendUint16(nil, uint16(len(b))), b...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// ninepDec reads the fields of a message, err is set when it's too short.
+type ninepDec struct {
+	b   []byte
+	err error
+}
+
+func (d *ninepDec) bytes(n int) []byte {
+	if d.err != nil || n < 0 || n > len(d.b) {
+		d.err = errNinePBadMsg
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *ninepDec) u8() uint8 {
+	if b := d.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *ninepDec) u16() uint16 {
+	if b := d.bytes(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *ninepDec) u32() uint32 {
+	if b := d.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *ninepDec) u64() uint64 {
+	if b := d.bytes(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *ninepDec) str() string {
+	return string(d.bytes(int(d.u16())))
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// ninepClient speaks 9P2000 to a connection served by ninepConn, one
+// message at a time.
+type ninepClient struct {
+	t    *testing.T
+	conn net.Conn
+	tag  uint16
+}
+
+// newNinePClient serves the current site on one end of a pipe and returns
+// a client, with the version negotiated, on the other.
+func newNinePClient(t *testing.T) *ninepClient {
+	t.Helper()
+	server, client := net.Pipe()
+	go newNinePConn(server).serve()
+	t.Cleanup(func() { client.Close() })
+	c := &ninepClient{t: t, conn: client}
+	d, err := c.rpc(tVersion, appendString(binary.LittleEndian.AppendUint32(nil, 8192), ninepVersion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.u32(); d.str() != ninepVersion {
+		t.Fatal("version not accepted")
+	}
+	return c
+}
+
+// rpc sends a T-message and returns the body of its R-message, or the
+// error of an Rerror.
+func (c *ninepClient) rpc(typ uint8, body []byte) (*ninepDec, error) {
+	c.t.Helper()
+	c.tag++
+	msg := binary.LittleEndian.AppendUint32(nil, uint32(7+len(body)))
+	msg = append(msg, typ)
+	msg = binary.LittleEndian.AppendUint16(msg, c.tag)
+	if _, err := c.conn.Write(append(msg, body...)); err != nil {
+		c.t.Fatal(err)
+	}
+	var hdr [7]byte
+	if _, err := io.ReadFull(c.conn, hdr[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	resp := make([]byte, binary.LittleEndian.Uint32(hdr[:4])-7)
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		c.t.Fatal(err)
+	}
+	if tag := binary.LittleEndian.Uint16(hdr[5:7]); tag != c.tag {
+		c.t.Fatalf("tag %d, want %d", tag, c.tag)
+	}
+	d := &ninepDec{b: resp}
+	switch hdr[4] {
+	case typ + 1:
+		return d, nil
+	case tError + 1:
+		return nil, ninepError(d.str())
+	}
+	c.t.Fatalf("response type %d to %d", hdr[4], typ)
+	return nil, nil
+}
+
+type ninepError string
+
+func (e ninepError) Error() string { return string(e) }
+
+func u32s(vs ...uint32) []byte {
+	var b []byte
+	for _, v := range vs {
+		b = binary.LittleEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+func (c *ninepClient) auth(afid uint32, user string) error {
+	_, err := c.rpc(tAuth, appendString(appendString(u32s(afid), user), ""))
+	return err
+}
+
+func (c *ninepClient) attach(fid, afid uint32, user string) error {
+	_, err := c.rpc(tAttach, appendString(appendString(u32s(fid, afid), user), ""))
+	return err
+}
+
+func (c *ninepClient) walk(fid, newfid uint32, names ...string) error {
+	b := binary.LittleEndian.AppendUint16(u32s(fid, newfid), uint16(len(names)))
+	for _, name := range names {
+		b = appendString(b, name)
+	}
+	d, err := c.rpc(tWalk, b)
+	if err == nil && int(d.u16()) != len(names) {
+		err = ninepError("partial walk")
+	}
+	return err
+}
+
+func (c *ninepClient) open(fid uint32, mode uint8) error {
+	_, err := c.rpc(tOpen, append(u32s(fid), mode))
+	return err
+}
+
+func (c *ninepClient) read(fid uint32) ([]byte, error) {
+	var data []byte
+	for {
+		b := binary.LittleEndian.AppendUint64(u32s(fid), uint64(len(data)))
+		d, err := c.rpc(tRead, append(b, u32s(4096)...))
+		if err != nil {
+			return nil, err
+		}
+		chunk := d.bytes(int(d.u32()))
+		if len(chunk) == 0 {
+			return data, nil
+		}
+		data = append(data, chunk...)
+	}
+}
+
+func (c *ninepClient) write(fid uint32, data []byte) error {
+	b := binary.LittleEndian.AppendUint64(u32s(fid), 0)
+	_, err := c.rpc(tWrite, append(append(b, u32s(uint32(len(data)))...), data...))
+	return err
+}
+
+func (c *ninepClient) clunk(fid uint32) error {
+	_, err := c.rpc(tClunk, u32s(fid))
+	return err
+}
+
+// readFile walks from the root fid 0 to the file and reads it.
+func (c *ninepClient) readFile(names ...string) (string, error) {
+	if err := c.walk(0, 100, names...); err != nil {
+		return "", err
+	}
+	defer c.clunk(100)
+	if err := c.open(100, 0); err != nil {
+		return "", err
+	}
+	data, err := c.read(100)
+	return string(data), err
+}
+
+// login attaches fid 0 as user with password, through auth fid 1.
+func (c *ninepClient) login(user, password string) error {
+	if err := c.auth(1, user); err != nil {
+		return err
+	}
+	if err := c.write(1, []byte(password)); err != nil {
+		return err
+	}
+	return c.attach(0, 1, user)
+}
+
+func newNinePSite(t *testing.T) string {
+	cfg := defaultSiteConfig()
+	cfg.Auth.Users = []siteUser{
+		{Username: "bob", Password: "pw", Write: true},
+		{Username: "eve", Password: "pw2"},
+	}
+	return newTestSite(t, cfg, map[string]string{
+		"a.md":               "# A\n",
+		"a.md.conf.json":     `{"title": "Page A"}`,
+		"docs/b.md":          "# B\n",
+		"private/.conf.json": `{"basic_auth": {"username": "u", "password": "p"}}`,
+		"private/secret.md":  "# Secret\n",
+		// without a password the node isn't protected, the field is
+		// still kept out of conf
+		"c.md":           "# C\n",
+		"c.md.conf.json": `{"title": "C", "basic_auth": {"username": "u"}}`,
+	})
+}
+
+func TestNinePRead(t *testing.T) {
+	newNinePSite(t)
+	c := newNinePClient(t)
+	if err := c.attach(0, ninepNoFid, "anyone"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		names []string
+		want  string
+	}{
+		{[]string{"a.md", "raw"}, "# A\n"},
+		{[]string{"a.md", "title"}, "Page A\n"},
+		{[]string{"a.md", "conf"}, `{"title": "Page A"}`},
+		{[]string{"c.md", "conf"}, "{\n    \"title\": \"C\"\n}\n"},
+		{[]string{"docs", "b.md", "raw"}, "# B\n"},
+		{[]string{"docs", "..", "a.md", "raw"}, "# A\n"},
+	} {
+		got, err := c.readFile(tt.names...)
+		if err != nil || got != tt.want {
+			t.Errorf("%v: got %q, %v, want %q", tt.names, got, err, tt.want)
+		}
+	}
+	html, err := c.readFile("a.md", "html")
+	if err != nil || !strings.Contains(html, "<h1") {
+		t.Errorf("html: got %q, %v", html, err)
+	}
+
+	for _, names := range [][]string{
+		{siteConfigName},
+		{"a.md.conf.json"},
+		{"private", "secret.md"},
+		{"docs", "nope.md"},
+		{"a.md", "raw", "raw"},
+	} {
+		if err := c.walk(0, 100, names...); err == nil {
+			t.Errorf("walked to %v", names)
+			c.clunk(100)
+		}
+	}
+
+	// the root directory lists the files of the node and the public nodes
+	if err := c.walk(0, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.open(100, 0); err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.read(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for d := (&ninepDec{b: data}); len(d.b) > 0 && d.err == nil; {
+		entry := &ninepDec{b: d.bytes(int(d.u16()))}
+		entry.bytes(2 + 4 + 13 + 4 + 4 + 4 + 8)
+		names = append(names, entry.str())
+	}
+	sort.Strings(names)
+	if want := "a.md c.md conf docs html raw title"; strings.Join(names, " ") != want {
+		t.Errorf("root lists %v, want %s", names, want)
+	}
+}
+
+func TestNinePWrite(t *testing.T) {
+	root := newNinePSite(t)
+	const oWriteTrunc = 1 | oTrunc
+	write := func(c *ninepClient, content string) error {
+		if err := c.walk(0, 100, "a.md", "raw"); err != nil {
+			return err
+		}
+		if err := c.open(100, oWriteTrunc); err != nil {
+			c.clunk(100)
+			return err
+		}
+		if err := c.write(100, []byte(content)); err != nil {
+			return err
+		}
+		// the page is saved when the fid is clunked
+		return c.clunk(100)
+	}
+	content := func() string {
+		b, _ := os.ReadFile(filepath.Join(root, "a.md"))
+		return string(b)
+	}
+
+	anon := newNinePClient(t)
+	if err := anon.attach(0, ninepNoFid, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(anon, "anonymous"); err == nil {
+		t.Error("anonymous write allowed")
+	}
+
+	reader := newNinePClient(t)
+	if err := reader.login("eve", "pw2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(reader, "no write permission"); err == nil {
+		t.Error("write allowed without write permission")
+	}
+
+	if err := newNinePClient(t).login("bob", "wrong"); err == nil {
+		t.Error("attached with a wrong password")
+	}
+
+	writer := newNinePClient(t)
+	if err := writer.login("bob", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(writer, "# Edited\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got := content(); got != "# Edited\n" {
+		t.Errorf("a.md is %q after the write", got)
+	}
+	// the conf file is read-only, also for writers
+	if err := writer.walk(0, 100, "a.md", "conf"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.open(100, 1); err == nil {
+		t.Error("conf opened for writing")
+	}
+}
+
+func TestNinePAuthPasswordLimit(t *testing.T) {
+	newNinePSite(t)
+	c := newNinePClient(t)
+	if err := c.auth(1, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	chunk := []byte(strings.Repeat("x", 512))
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = c.write(1, chunk)
+	}
+	if err == nil {
+		t.Error("auth fid took more than 1 KiB")
+	}
+}
+
+func TestNinePProtectedRoot(t *testing.T) {
+	cfg := defaultSiteConfig()
+	cfg.Auth.Users = []siteUser{{Username: "bob", Password: "pw", Write: true}}
+	newTestSite(t, cfg, map[string]string{
+		".conf.json": `{"auth_token": "secret"}`,
+		"a.md":       "# A\n",
+	})
+	if err := newNinePClient(t).attach(0, ninepNoFid, "anyone"); err == nil {
+		t.Error("attached to a protected root anonymously")
+	}
+	if err := newNinePClient(t).login("bob", "pw"); err == nil {
+		t.Error("attached to a protected root")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resolveNodePath returns the file of the node at p, a slash separated
+// path relative to the root. Paths leading outside of the root or through
+// protected files are refused: dot files, .conf.json, the site config,
+// _order and the _ directories (templates, static files). Index pages
+// are fine.
+func resolveNodePath(p string) (string, error) {
+	rel := filepath.Clean("/" + filepath.FromSlash(p))
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		if elem == "" || elem == "index.md" || elem == "index.html" || elem == robotsName {
+			continue
+		}
+		if isReservedName(elem) {
+			return "", fmt.Errorf("%s: protected path", p)
+		}
+	}
+	absPath := filepath.Join(_rootDir, rel)
+	if r, err := filepath.Rel(_rootDir, absPath); err != nil || strings.HasPrefix(r, "..") {
+		return "", fmt.Errorf("%s: outside of the root directory", p)
+	}
+	return absPath, nil
+}
+
+// writeNodeFile writes the content of a node, creating its directories.
+func writeNodeFile(absPath string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(absPath, content)
+}
+
+// writeFileAtomic writes the file through a temporary file renamed over
+// it, readers see the old or the new content, never a partial one.
+func writeFileAtomic(fpath string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(fpath), "."+filepath.Base(fpath)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fpath)
+}
+
+// errDirNotEmpty is returned when removing a directory with nodes in it.
+var errDirNotEmpty = errors.New("cannot remove non-empty directory")
+
+// removeNodeFile removes a file or an empty directory (ignoring hidden and
+// config files) and its .conf.json. It returns the removed files.
+func removeNodeFile(absPath string) ([]string, error) {
+	fileInfo, err := os.Stat(absPath)
+	if err != nil {
+		return nil, err
+	}
+	if fileInfo.IsDir() {
+		entries, err := os.ReadDir(absPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !isReservedName(entry.Name()) {
+				return nil, errDirNotEmpty
+			}
+		}
+		// remove the empty directory and its config file
+		configPath := filepath.Join(absPath, ".conf.json")
+		if _, err := os.Stat(configPath); err == nil {
+			if err := os.Remove(configPath); err != nil {
+				return nil, fmt.Errorf("failed to remove config file: %v", err)
+			}
+		}
+		if err := os.Remove(absPath); err != nil {
+			return nil, fmt.Errorf("failed to remove directory: %v", err)
+		}
+		return []string{absPath, configPath}, nil
+	}
+
+	// remove the file and its config file
+	if err := os.Remove(absPath); err != nil {
+		return nil, err
+	}
+	configPath := absPath + ".conf.json"
+	if _, err := os.Stat(configPath); err == nil {
+		if err := os.Remove(configPath); err != nil {
+			return []string{absPath}, fmt.Errorf("file removed but failed to remove config file: %v", err)
+		}
+	}
+	return []string{absPath, configPath}, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+// openAPIDoc describes the API, served at /_api/v1/openapi.json.
+const openAPIDoc = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "crew API",
+    "version": "1.0.0",
+    "description": "Read and write the nodes of a crew site. Paths are relative to the root directory, protected files (dot files, .conf.json, crew.json, _ files) can't be accessed. Writes are committed when history is enabled."
+  },
+  "servers": [{"url": "/_api/v1"}],
+  "security": [{"bearer": []}],
+  "components": {
+    "securitySchemes": {
+      "bearer": {
+        "type": "http",
+        "scheme": "bearer",
+        "description": "A token from the api.tokens of crew.json, with the read, write or delete scope for the path."
+      }
+    },
+    "parameters": {
+      "path": {
+        "name": "path",
+        "in": "path",
+        "required": true,
+        "description": "Path of the node, e.g. blog/hello.md, a trailing slash for directories.",
+        "schema": {"type": "string"}
+      }
+    },
+    "schemas": {
+      "Node": {
+        "type": "object",
+        "properties": {
+          "path": {"type": "string"},
+          "url": {"type": "string"},
+          "title": {"type": "string"},
+          "desc": {"type": "string"},
+          "date": {"type": "string", "format": "date-time"},
+          "modified": {"type": "string", "format": "date-time"},
+          "is_dir": {"type": "boolean"},
+          "hidden": {"type": "boolean"},
+          "tags": {"type": "array", "items": {"type": "string"}},
+          "conf": {"type": "object", "description": "The .conf.json fields, without auth_token and basic_auth."},
+          "content": {"type": "string", "description": "The content of the file, or of the index page of a directory."},
+          "children": {"type": "array", "items": {"$ref": "#/components/schemas/Node"}, "description": "Directories only, without conf, content and children."}
+        }
+      },
+      "PutBody": {
+        "type": "object",
+        "properties": {
+          "content": {"type": "string"},
+          "conf": {"type": "object", "description": "Replaces the .conf.json."}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "properties": {"error": {"type": "string"}}
+      }
+    },
+    "responses": {
+      "Node": {
+        "description": "The node.",
+        "headers": {"ETag": {"schema": {"type": "string"}}},
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Node"}}}
+      },
+      "Error": {
+        "description": "401 without a valid token, 403 when the token or the path isn't allowed, 404 when there's no such node, 409 on conflicts, 412 when If-Match or If-None-Match fail.",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      }
+    }
+  },
+  "paths": {
+    "/nodes/{path}": {
+      "parameters": [{"$ref": "#/components/parameters/path"}],
+      "get": {
+        "summary": "Get a node with its content, conf and children.",
+        "description": "Scope read.",
+        "responses": {"200": {"$ref": "#/components/responses/Node"}, "304": {"description": "If-None-Match matches."}, "default": {"$ref": "#/components/responses/Error"}}
+      },
+      "put": {
+        "summary": "Create or replace a node.",
+        "description": "Scope write. The body is the content of the file, or a JSON PutBody with application/json. A path ending with a slash creates a directory, content goes to its index.md. If-Match makes it conditional, If-None-Match: * only creates.",
+        "requestBody": {
+          "content": {
+            "text/markdown": {"schema": {"type": "string"}},
+            "application/json": {"schema": {"$ref": "#/components/schemas/PutBody"}}
+          }
+        },
+        "responses": {"200": {"$ref": "#/components/responses/Node"}, "201": {"$ref": "#/components/responses/Node"}, "default": {"$ref": "#/components/responses/Error"}}
+      },
+      "patch": {
+        "summary": "Update .conf.json fields.",
+        "description": "Scope write. The fields of the body are set, null removes a field.",
+        "requestBody": {"content": {"application/json": {"schema": {"type": "object"}}}},
+        "responses": {"200": {"$ref": "#/components/responses/Node"}, "default": {"$ref": "#/components/responses/Error"}}
+      },
+      "delete": {
+        "summary": "Remove a file or an empty directory and its .conf.json.",
+        "description": "Scope delete.",
+        "responses": {"204": {"description": "Removed."}, "default": {"$ref": "#/components/responses/Error"}}
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// orderFileName is the file in a directory listing the names of its
+// children in the order they're shown, one per line. Children not listed
+// come after, sorted as usual.
+const orderFileName = "_order"
+
+const (
+	orderTitle = "title"
+	orderDate  = "date"
+)
+
+func validateOrder(order string) error {
+	switch order {
+	case "", orderTitle, orderDate:
+		return nil
+	}
+	return fmt.Errorf("unknown order: %s", order)
+}
+
+// readOrderFile returns the position of every name listed in the _order
+// file of dir, blank lines and # comments are skipped.
+func readOrderFile(dir string) map[string]int {
+	f, err := os.Open(path.Join(dir, orderFileName))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	pos := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" || strings.HasPrefix(name, "#") {
+			continue
+		}
+		if _, ok := pos[name]; !ok {
+			pos[name] = len(pos)
+		}
+	}
+	return pos
+}
+
+// sortNodes sorts the children of dir: names listed in its _order file
+// first, then by weight, then by the directory's order, directories before
+// files and by title by default, newest first for "date" and blogs. File
+// names break the remaining ties so the order never depends on the input.
+func sortNodes(dir *node, ns []*node) {
+	var pos map[string]int
+	order := ""
+	if dir != nil {
+		pos = readOrderFile(dir.filepath)
+		order = dir.order
+		if order == "" && dir.isBlog() {
+			order = orderDate
+		}
+	}
+	rank := func(n *node) int {
+		if p, ok := pos[filepath.Base(n.filepath)]; ok {
+			return p
+		}
+		return len(pos)
+	}
+	sort.SliceStable(ns, func(i, j int) bool {
+		a, b := ns[i], ns[j]
+		if ra, rb := rank(a), rank(b); ra != rb {
+			return ra < rb
+		}
+		if a.weight != b.weight {
+			return a.weight < b.weight
+		}
+		if order == orderDate {
+			if da, db := a.pubDate(), b.pubDate(); !da.Equal(db) {
+				return da.After(db)
+			}
+		} else if a.isDir != b.isDir {
+			return a.isDir
+		}
+		if a.title != b.title {
+			return a.title < b.title
+		}
+		return a.filepath < b.filepath
+	})
+}
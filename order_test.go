@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSortNodes(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+	file := func(name, title string) *node {
+		return &node{filepath: "/site/" + name, title: title, modTime: day(1)}
+	}
+	dated := func(name string, d int) *node {
+		n := file(name, name)
+		n.date = day(d)
+		return n
+	}
+	weighted := func(n *node, w int) *node {
+		n.weight = w
+		return n
+	}
+	dir := func(name, title string) *node {
+		n := file(name, title)
+		n.isDir = true
+		return n
+	}
+
+	tests := []struct {
+		name  string
+		order string
+		mode  string
+		// orderFile is the content of the _order file, if any
+		orderFile string
+		nodes     []*node
+		want      []string
+	}{
+		{
+			name:  "directories first, then by title",
+			nodes: []*node{file("b.md", "B"), dir("z", "Z"), file("a.md", "A"), dir("y", "Y")},
+			want:  []string{"y", "z", "a.md", "b.md"},
+		},
+		{
+			name:  "file names break title ties",
+			nodes: []*node{file("2.md", "Same"), file("3.md", "Same"), file("1.md", "Same")},
+			want:  []string{"1.md", "2.md", "3.md"},
+		},
+		{
+			name:  "lower weight first",
+			nodes: []*node{file("a.md", "A"), weighted(file("z.md", "Z"), -10), weighted(dir("d", "D"), 5)},
+			want:  []string{"z.md", "a.md", "d"},
+		},
+		{
+			name:      "_order file first, in its order",
+			orderFile: "# pinned\nc.md\n\na.md\nmissing.md\n",
+			nodes:     []*node{weighted(file("a.md", "A"), 10), file("b.md", "B"), file("c.md", "C"), weighted(file("d.md", "D"), -1)},
+			want:      []string{"c.md", "a.md", "d.md", "b.md"},
+		},
+		{
+			name:  "date order, newest first",
+			order: orderDate,
+			nodes: []*node{dated("old.md", 1), dated("new.md", 3), dir("dir", "dir"), dated("mid.md", 2)},
+			// dir has the modification time of day 1, like old.md, the
+			// title breaks the tie
+			want: []string{"new.md", "mid.md", "dir", "old.md"},
+		},
+		{
+			name:  "blogs default to date order",
+			mode:  modeBlog,
+			nodes: []*node{dated("a.md", 1), dated("b.md", 2)},
+			want:  []string{"b.md", "a.md"},
+		},
+		{
+			name:  "title order ignores dates",
+			order: orderTitle,
+			mode:  modeBlog,
+			nodes: []*node{dated("b.md", 2), dated("a.md", 1)},
+			want:  []string{"a.md", "b.md"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if tt.orderFile != "" {
+				if err := os.WriteFile(filepath.Join(root, orderFileName), []byte(tt.orderFile), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			parent := &node{filepath: root, isDir: true, order: tt.order, mode: tt.mode}
+			// every rotation of the input gives the same order
+			for i := range tt.nodes {
+				ns := append(append([]*node{}, tt.nodes[i:]...), tt.nodes[:i]...)
+				sortNodes(parent, ns)
+				var got []string
+				for _, n := range ns {
+					got = append(got, filepath.Base(n.filepath))
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("rotation %d: got %v, want %v", i, got, tt.want)
+				}
+			}
+		})
+	}
+}
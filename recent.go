@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"html"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/c4pt0r/log"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+const (
+	recentPath = "/_recent"
+	// recentLimit is the default number of nodes on the recent changes page
+	recentLimit   = 50
+	modTimeFormat = "2006-01-02 15:04"
+)
+
+// commitInfo is the last commit touching a file, when the root directory
+// is in a git repository.
+type commitInfo struct {
+	Hash   string
+	Short  string
+	Author string
+	Date   time.Time
+}
+
+// commitIndex is the last commit of every file of the repository as of a
+// HEAD, by path relative to its worktree. Pages only read it, it's built in
+// the background by watchTree.
+type commitIndex struct {
+	head  plumbing.Hash
+	root  string
+	files map[string]*commitInfo
+}
+
+var _commitIndex atomic.Pointer[commitIndex]
+
+// updateCommitIndex rebuilds the commit index when HEAD moved. The history
+// is walked once, then only down to the previous HEAD.
+func updateCommitIndex() {
+	repo := gitRepo()
+	if repo == nil {
+		return
+	}
+	head, err := repo.Head()
+	if err != nil {
+		// no commits yet
+		return
+	}
+	old := _commitIndex.Load()
+	if old != nil && old.head == head.Hash() {
+		return
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		log.E(err)
+		return
+	}
+	root, err := filepath.Abs(wt.Filesystem.Root())
+	if err != nil {
+		log.E(err)
+		return
+	}
+	idx := &commitIndex{head: head.Hash(), root: root, files: make(map[string]*commitInfo)}
+	stop := plumbing.ZeroHash
+	if old != nil && old.root == root {
+		stop = old.head
+	}
+	if err := idx.walk(repo, stop); err != nil {
+		log.E(err)
+		return
+	}
+	if stop != plumbing.ZeroHash {
+		for f, c := range old.files {
+			if _, ok := idx.files[f]; !ok {
+				idx.files[f] = c
+			}
+		}
+	}
+	_commitIndex.Store(idx)
+}
+
+// walk records the newest commit changing each file, from HEAD down to the
+// stop commit.
+func (idx *commitIndex) walk(repo *git.Repository, stop plumbing.Hash) error {
+	iter, err := repo.Log(&git.LogOptions{From: idx.head, Order: git.LogOrderCommitterTime})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	return iter.ForEach(func(c *object.Commit) error {
+		if c.Hash == stop {
+			return storer.ErrStop
+		}
+		tree, err := c.Tree()
+		if err != nil {
+			return err
+		}
+		var parentTree *object.Tree
+		if c.NumParents() > 0 {
+			parent, err := c.Parent(0)
+			if err != nil {
+				return err
+			}
+			if parentTree, err = parent.Tree(); err != nil {
+				return err
+			}
+		}
+		changes, err := object.DiffTree(parentTree, tree)
+		if err != nil {
+			return err
+		}
+		hash := c.Hash.String()
+		info := &commitInfo{Hash: hash, Short: hash[:7], Author: c.Author.Name, Date: c.Author.When}
+		for _, ch := range changes {
+			if name := ch.To.Name; name != "" {
+				if _, ok := idx.files[name]; !ok {
+					idx.files[name] = info
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// lastCommit returns the last commit of the node's content file, or nil if
+// it isn't committed, the root isn't in a git repository or its commits
+// aren't indexed yet.
+func (n *node) lastCommit() *commitInfo {
+	idx := _commitIndex.Load()
+	fpath := n.contentFile()
+	if idx == nil || fpath == "" {
+		return nil
+	}
+	abs, err := filepath.Abs(fpath)
+	if err != nil {
+		return nil
+	}
+	rel, err := filepath.Rel(idx.root, abs)
+	if err != nil {
+		return nil
+	}
+	return idx.files[filepath.ToSlash(rel)]
+}
+
+// recentNode is a node with its modification time, looked up once.
+type recentNode struct {
+	*node
+	modTime time.Time
+}
+
+// recentNodes returns the visible nodes, most recently modified first.
+func recentNodes(limit int) []recentNode {
+	idx := getSiteIndex()
+	if idx == nil {
+		return nil
+	}
+	var nodes []recentNode
+	for _, n := range idx.nodes {
+		if idx.isVisible(n) {
+			nodes = append(nodes, recentNode{n, n.lastMod()})
+		}
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].modTime.After(nodes[j].modTime)
+	})
+	if limit > 0 && len(nodes) > limit {
+		nodes = nodes[:limit]
+	}
+	return nodes
+}
+
+// recentPage lists the most recently modified nodes, ?n= changes how many.
+func recentPage(r *http.Request) *page {
+	p := pageFromNode(getRootNode())
+	p.Title = "Recent changes"
+	limit := recentLimit
+	if v, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil && v > 0 {
+		limit = v
+	}
+	p.bodyRender = func(p *page, ctx context.Context) ([]byte, error) {
+		var buf bytes.Buffer
+		buf.WriteString("<h1> Recent changes </h1>")
+		nodes := recentNodes(limit)
+		if len(nodes) == 0 {
+			buf.WriteString("<p>Nothing yet.</p>")
+			return buf.Bytes(), nil
+		}
+		buf.WriteString("<ul class=\"recent\">")
+		for _, n := range nodes {
+			buf.WriteString("<li><time>" + n.modTime.Format(modTimeFormat) + "</time> ")
+			buf.WriteString("<a href=\"" + n.href() + "\">" + n.title + "</a>")
+			if c := n.lastCommit(); c != nil {
+				buf.WriteString(" <small>" + html.EscapeString(c.Author) + ", " + c.Short + "</small>")
+			}
+			buf.WriteString("</li>")
+		}
+		buf.WriteString("</ul>")
+		return buf.Bytes(), nil
+	}
+	return p
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecentNodes(t *testing.T) {
+	root := newTestSite(t, defaultSiteConfig(), map[string]string{
+		"old.md":             "# Old\n",
+		"new.md":             "# New\n",
+		"mid.md":             "# Mid\n",
+		"private/.conf.json": `{"auth_token": "x"}`,
+		"private/secret.md":  "# Secret\n",
+	})
+	now := time.Now()
+	for name, age := range map[string]time.Duration{
+		"old.md": 3 * time.Hour, "mid.md": 2 * time.Hour, "new.md": time.Hour,
+		"private/secret.md": 0, "private": 4 * time.Hour, ".": 5 * time.Hour,
+	} {
+		if err := os.Chtimes(filepath.Join(root, name), now, now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rebuildSiteIndex()
+	var got []string
+	for _, n := range recentNodes(3) {
+		got = append(got, filepath.Base(n.filepath))
+	}
+	if want := []string{"new.md", "mid.md", "old.md"}; len(got) != 3 || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("recent nodes %v, want %v", got, want)
+	}
+}
+
+func TestCommitIndex(t *testing.T) {
+	cfg := defaultSiteConfig()
+	cfg.History.Enabled = true
+	cfg.History.GitDir = filepath.Join(t.TempDir(), "site.git")
+	root := newTestSite(t, cfg, map[string]string{"a.md": "# A\n", "b.md": "# B\n"})
+	oldRepo, oldOpened, oldIdx := _repo, _repoOpened, _commitIndex.Load()
+	_repo, _repoOpened = nil, false
+	_commitIndex.Store(nil)
+	t.Cleanup(func() {
+		_repo, _repoOpened = oldRepo, oldOpened
+		_commitIndex.Store(oldIdx)
+	})
+	if err := initHistory(); err != nil {
+		t.Fatal(err)
+	}
+	node := func(name string) *node {
+		n, err := newNodeFromPath(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	author := func(name string) string {
+		if c := node(name).lastCommit(); c != nil {
+			return c.Author
+		}
+		return ""
+	}
+
+	if err := commitFiles("bob", "Add", filepath.Join(root, "a.md"), filepath.Join(root, "b.md")); err != nil {
+		t.Fatal(err)
+	}
+	if got := author("a.md"); got != "" {
+		t.Errorf("commit of a.md looked up before the index was updated: %s", got)
+	}
+	updateCommitIndex()
+	if got := author("a.md"); got != "bob" {
+		t.Errorf("a.md committed by %q, want bob", got)
+	}
+
+	// only the commits since the last HEAD are walked, the others are kept
+	if err := os.WriteFile(filepath.Join(root, "b.md"), []byte("# B2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitFiles("eve", "Edit", filepath.Join(root, "b.md")); err != nil {
+		t.Fatal(err)
+	}
+	updateCommitIndex()
+	if a, b := author("a.md"), author("b.md"); a != "bob" || b != "eve" {
+		t.Errorf("a.md by %q, b.md by %q, want bob and eve", a, b)
+	}
+}
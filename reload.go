@@ -0,0 +1,165 @@
+package main
+
+import (
+	"flag"
+	"html"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/c4pt0r/log"
+)
+
+// reloadInterval is how often the watched files are checked for changes.
+const reloadInterval = time.Second
+
+var (
+	// _globalTpl is the source of the custom page template (-page-tpl),
+	// nil means the default pageTpl
+	_globalTpl atomic.Pointer[string]
+	// _reloadErr is the error of the last failed reload, the previous
+	// config and template are kept running meanwhile
+	_reloadErr atomic.Pointer[error]
+)
+
+func getGlobalTemplate() string {
+	if tpl := _globalTpl.Load(); tpl != nil {
+		return *tpl
+	}
+	return pageTpl
+}
+
+// reload loads the site config, the custom page template and the root node
+// and swaps them in. Nothing is swapped if any of them fails, so the last
+// good version keeps serving. The root directory and the listen address
+// can't change on a running server.
+func reload() error {
+	err := doReload()
+	if err != nil {
+		_reloadErr.Store(&err)
+	} else {
+		_reloadErr.Store(nil)
+	}
+	return err
+}
+
+func doReload() error {
+	cfg, err := loadSiteConfig(flag.CommandLine, *configFile)
+	if err != nil {
+		return err
+	}
+	old := _siteConfig.Load()
+	if old != nil {
+		if cfg.RootDir != old.RootDir || cfg.Addr != old.Addr {
+			log.W("root_dir and addr changes need a restart")
+			cfg.RootDir, cfg.Addr = old.RootDir, old.Addr
+		}
+	}
+
+	var tpl *string
+	if cfg.PageTpl != "" {
+		b, err := os.ReadFile(cfg.PageTpl)
+		if err != nil {
+			return err
+		}
+		if _, err := template.New("page").Parse(string(b)); err != nil {
+			return err
+		}
+		s := string(b)
+		tpl = &s
+	}
+
+	root, err := newNodeFromPath(cfg.RootDir)
+	if err != nil {
+		return err
+	}
+
+	if old == nil {
+		_rootDir = cfg.RootDir
+	}
+	_siteConfig.Store(cfg)
+	_globalTpl.Store(tpl)
+	_rootNode.Store(root)
+	clearTemplateCache()
+	return nil
+}
+
+// watchedFiles returns the files whose changes trigger a reload.
+func watchedFiles() []string {
+	cfg := getSiteConfig()
+	files := []string{
+		siteConfigPath(*configFile, cfg.RootDir),
+		filepath.Join(cfg.RootDir, ".conf.json"),
+	}
+	if cfg.PageTpl != "" {
+		files = append(files, cfg.PageTpl)
+	}
+	return files
+}
+
+func modTimes(files []string) map[string]time.Time {
+	m := make(map[string]time.Time, len(files))
+	for _, f := range files {
+		// a missing file gets the zero time, so creating it is a change too
+		if fi, err := os.Stat(f); err == nil {
+			m[f] = fi.ModTime()
+		} else {
+			m[f] = time.Time{}
+		}
+	}
+	return m
+}
+
+func changed(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return true
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || !w.Equal(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchReload polls the site config, the page template and the root
+// .conf.json and reloads when one of them changes, or on SIGHUP.
+func watchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+
+	last := modTimes(watchedFiles())
+	for {
+		select {
+		case <-hup:
+			log.I("SIGHUP received, reloading")
+		case <-ticker.C:
+			cur := modTimes(watchedFiles())
+			if !changed(last, cur) {
+				continue
+			}
+			last = cur
+			log.I("site config or template changed, reloading")
+		}
+		if err := reload(); err != nil {
+			log.E("reload failed, keeping the last good config:", err)
+		}
+		last = modTimes(watchedFiles())
+	}
+}
+
+// devBanner returns an error banner for the last failed reload in dev mode.
+func devBanner() string {
+	errp := _reloadErr.Load()
+	if errp == nil || !getSiteConfig().Dev {
+		return ""
+	}
+	return `<div class="dev-error" style="border: 2px solid #e06c75; padding: 0.5em 1em; margin-bottom: 1em;">` +
+		`<b>reload failed, serving the last good version:</b> <pre>` + html.EscapeString((*errp).Error()) + `</pre></div>`
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Renderer renders the file of a node.
+type Renderer interface {
+	// Render returns the body of the page of the node, or the whole
+	// response for standalone renderers
+	Render(ctx context.Context, n *node) ([]byte, error)
+	// ContentType is the media type of the output of Render for the file
+	ContentType(n *node) string
+	// Standalone reports whether the output is served as is, instead of
+	// in the page template
+	Standalone() bool
+}
+
+const htmlContentType = "text/html; charset=utf-8"
+
+// renderers are the renderers that site config can map extensions to.
+var renderers = map[string]Renderer{
+	"markdown": markdownRenderer{},
+	"html":     htmlRenderer{},
+	"lua":      luaRenderer{},
+	"text":     textRenderer{},
+	"file":     fileRenderer{},
+}
+
+// extRenderers are the renderers of the extensions known out of the box,
+// the others are text.
+var extRenderers = map[string]string{
+	".md":   "markdown",
+	".html": "html",
+	".lua":  "lua",
+}
+
+// rendererConfig is the "renderers" section of the site config: the name
+// of the renderer of extensions, e.g. {".markdown": "markdown"}.
+type rendererConfig map[string]string
+
+func (c rendererConfig) validate() error {
+	for ext, name := range c {
+		if !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("renderers: extension %q must start with a dot", ext)
+		}
+		if _, ok := renderers[name]; !ok {
+			return fmt.Errorf("renderers: unknown renderer %q for %s", name, ext)
+		}
+	}
+	return nil
+}
+
+// rendererFor returns the renderer of a file extension: the one of the
+// site config, a built-in one, else text.
+func rendererFor(ext string) Renderer {
+	ext = strings.ToLower(ext)
+	name, ok := getSiteConfig().Renderers[ext]
+	if !ok {
+		name = extRenderers[ext]
+	}
+	if r, ok := renderers[name]; ok {
+		return r
+	}
+	return textRenderer{}
+}
+
+type markdownRenderer struct{}
+
+func (markdownRenderer) Render(ctx context.Context, n *node) ([]byte, error) {
+	return n.renderMarkdown(ctx)
+}
+
+func (markdownRenderer) ContentType(*node) string { return htmlContentType }
+func (markdownRenderer) Standalone() bool         { return false }
+
+// htmlRenderer puts HTML files in the page as they are.
+type htmlRenderer struct{}
+
+func (htmlRenderer) Render(ctx context.Context, n *node) ([]byte, error) {
+	return n.renderHTML(ctx)
+}
+
+func (htmlRenderer) ContentType(*node) string { return htmlContentType }
+func (htmlRenderer) Standalone() bool         { return false }
+
+type luaRenderer struct{}
+
+func (luaRenderer) Render(ctx context.Context, n *node) ([]byte, error) {
+	return n.renderLua(ctx)
+}
+
+func (luaRenderer) ContentType(*node) string { return htmlContentType }
+func (luaRenderer) Standalone() bool         { return false }
+
+// textRenderer shows text and source files escaped and highlighted, with
+// line numbers and links to the raw file.
+type textRenderer struct{}
+
+func (textRenderer) Render(ctx context.Context, n *node) ([]byte, error) {
+	content, err := n.rawContent()
+	if err != nil {
+		return nil, err
+	}
+	name := html.EscapeString(filepath.Base(n.filepath))
+	raw := html.EscapeString(n.href()) + "?raw=1"
+	var buf bytes.Buffer
+	if !isText(content) {
+		fmt.Fprintf(&buf, `<p class="source-info">%s is a binary file of %d bytes, <a href="%s" download="%s">download</a></p>`,
+			name, len(content), raw, name)
+		return buf.Bytes(), nil
+	}
+	lines := bytes.Count(content, []byte("\n"))
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		lines++
+	}
+	fmt.Fprintf(&buf, `<div class="source"><p class="source-info">%s, %d lines, %d bytes <a href="%s">raw</a> <a href="%s" download="%s">download</a></p>`,
+		name, lines, len(content), raw, raw, name)
+	if err := highlightSource(&buf, string(content), n.filepath); err != nil {
+		buf.WriteString("<pre>" + html.EscapeString(string(content)) + "</pre>")
+	}
+	buf.WriteString("</div>")
+	return buf.Bytes(), nil
+}
+
+func (textRenderer) ContentType(*node) string { return htmlContentType }
+func (textRenderer) Standalone() bool         { return false }
+
+// isText reports whether content looks like text: UTF-8 without NUL bytes.
+func isText(content []byte) bool {
+	return utf8.Valid(content) && bytes.IndexByte(content, 0) < 0
+}
+
+// isRawRequest reports whether the request asks for the file itself with
+// ?raw=1, which is allowed for files but not Lua scripts: they run on the
+// server and their source isn't for visitors.
+func isRawRequest(r *http.Request, n *node) bool {
+	if v := r.URL.Query().Get("raw"); (v != "1" && v != "true") || n.isDir {
+		return false
+	}
+	_, isLua := n.renderer().(luaRenderer)
+	return !isLua
+}
+
+// rawContentType returns the media type of a file served as is, text
+// without a known type is text/plain.
+func rawContentType(n *node, content []byte) string {
+	t := mime.TypeByExtension(n.ext())
+	if t == "" {
+		t = http.DetectContentType(content)
+		if isText(content) {
+			t = "text/plain; charset=utf-8"
+		}
+	}
+	if strings.HasPrefix(t, "text/") && !strings.Contains(t, "charset") {
+		t += "; charset=utf-8"
+	}
+	return t
+}
+
+// fileRenderer serves the file as is with the type of its extension, for
+// images or PDFs.
+type fileRenderer struct{}
+
+func (fileRenderer) Render(ctx context.Context, n *node) ([]byte, error) {
+	return n.rawContent()
+}
+
+func (fileRenderer) ContentType(n *node) string {
+	if t := mime.TypeByExtension(n.ext()); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+func (fileRenderer) Standalone() bool { return true }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsRawRequest(t *testing.T) {
+	root := newTestSite(t, defaultSiteConfig(), map[string]string{
+		"a.md":     "# A\n",
+		"code.go":  "package main\n",
+		"page.lua": "return 'hi'\n",
+		"dir/b.md": "# B\n",
+	})
+	tests := []struct {
+		file, query string
+		want        bool
+	}{
+		{"a.md", "?raw=1", true},
+		{"code.go", "?raw=true", true},
+		{"a.md", "", false},
+		{"a.md", "?raw=0", false},
+		{"page.lua", "?raw=1", false},
+		{"dir", "?raw=1", false},
+	}
+	for _, tt := range tests {
+		n, err := newNodeFromPath(filepath.Join(root, tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/"+tt.file+tt.query, nil)
+		if got := isRawRequest(r, n); got != tt.want {
+			t.Errorf("%s%s: got %v, want %v", tt.file, tt.query, got, tt.want)
+		}
+	}
+}
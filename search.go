@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"html"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/c4pt0r/log"
+	"github.com/gomarkdown/markdown"
+)
+
+const (
+	// searchPath is the search page, it takes the query in ?q=
+	searchPath = "/search"
+	// searchLimit is the max number of results on the search page
+	searchLimit = 50
+	// snippetRadius is the number of characters kept around the first match
+	snippetRadius = 80
+)
+
+// title and description matches weigh more than body matches
+const (
+	titleWeight = 5
+	descWeight  = 2
+)
+
+// searchDoc is an indexed node.
+type searchDoc struct {
+	node *node
+	// text is the plain text of the body, for snippets
+	text   string
+	terms  map[string]int
+	length int
+}
+
+// searchIndex is an inverted index over the title, description and text
+// of every node, it's updated file by file as the tree changes.
+type searchIndex struct {
+	sync.RWMutex
+	// docs maps the cleaned node path to its document
+	docs map[string]*searchDoc
+	// postings maps a term to the paths of the docs containing it
+	postings map[string]map[string]struct{}
+}
+
+type searchResult struct {
+	node    *node
+	score   float64
+	snippet string
+}
+
+var (
+	_searchIndex = &searchIndex{
+		docs:     make(map[string]*searchDoc),
+		postings: make(map[string]map[string]struct{}),
+	}
+)
+
+func getSearchIndex() *searchIndex {
+	return _searchIndex
+}
+
+// tokenize splits text into lower-cased words.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// stripTags returns the text of an HTML document, script and style
+// elements are dropped.
+func stripTags(s string) string {
+	var sb strings.Builder
+	for len(s) > 0 {
+		lt := strings.IndexByte(s, '<')
+		if lt < 0 {
+			sb.WriteString(s)
+			break
+		}
+		sb.WriteString(s[:lt])
+		s = s[lt:]
+		gt := strings.IndexByte(s, '>')
+		if gt < 0 {
+			break
+		}
+		tag := strings.ToLower(s[:gt+1])
+		s = s[gt+1:]
+		for _, skip := range []string{"script", "style"} {
+			if strings.HasPrefix(tag, "<"+skip) {
+				if end := strings.Index(strings.ToLower(s), "</"+skip); end >= 0 {
+					s = s[end:]
+				}
+			}
+		}
+		sb.WriteByte(' ')
+	}
+	return strings.Join(strings.Fields(html.UnescapeString(sb.String())), " ")
+}
+
+// nodeText returns the plain text of the content of a markdown or HTML
+// node, directories give the text of their index page.
+func nodeText(n *node) string {
+	target := n
+	if n.isDir {
+		idx, err := getIndexNodeForDir(n.filepath)
+		if err != nil || idx == nil {
+			return ""
+		}
+		target = idx
+	}
+	switch target.ext() {
+	case ".md":
+		content, err := os.ReadFile(target.filepath)
+		if err != nil {
+			return ""
+		}
+		return stripTags(string(markdown.ToHTML(stripFrontMatter(content), nil, nil)))
+	case ".html":
+		content, err := os.ReadFile(target.filepath)
+		if err != nil {
+			return ""
+		}
+		return stripTags(string(content))
+	}
+	return ""
+}
+
+func newSearchDoc(n *node) *searchDoc {
+	doc := &searchDoc{
+		node:  n,
+		text:  nodeText(n),
+		terms: make(map[string]int),
+	}
+	add := func(text string, weight int) {
+		for _, t := range tokenize(text) {
+			doc.terms[t] += weight
+			doc.length++
+		}
+	}
+	add(n.title, titleWeight)
+	add(n.desc, descWeight)
+	add(doc.text, 1)
+	return doc
+}
+
+func (idx *searchIndex) add(doc *searchDoc) {
+	key := path.Clean(doc.node.filepath)
+	idx.remove(key)
+	idx.docs[key] = doc
+	for t := range doc.terms {
+		if idx.postings[t] == nil {
+			idx.postings[t] = make(map[string]struct{})
+		}
+		idx.postings[t][key] = struct{}{}
+	}
+}
+
+func (idx *searchIndex) remove(key string) {
+	doc, ok := idx.docs[key]
+	if !ok {
+		return
+	}
+	for t := range doc.terms {
+		delete(idx.postings[t], key)
+		if len(idx.postings[t]) == 0 {
+			delete(idx.postings, t)
+		}
+	}
+	delete(idx.docs, key)
+}
+
+// build indexes the root and every node below it.
+func (idx *searchIndex) build() {
+	start := time.Now()
+	root := getRootNode()
+	docs := []*searchDoc{newSearchDoc(root)}
+	walkNodes(root, func(n *node) {
+		docs = append(docs, newSearchDoc(n))
+	})
+	idx.Lock()
+	defer idx.Unlock()
+	idx.docs = make(map[string]*searchDoc)
+	idx.postings = make(map[string]map[string]struct{})
+	for _, doc := range docs {
+		idx.add(doc)
+	}
+	log.Infof("search index built, %d docs in %s", len(docs), time.Since(start))
+}
+
+// nodePathForFile returns the path of the node whose content or metadata
+// is stored in fpath.
+func nodePathForFile(fpath string) string {
+	dir, name := path.Split(path.Clean(fpath))
+	switch {
+	case name == ".conf.json" || name == "index.md" || name == "index.html":
+		return path.Clean(dir)
+	case strings.HasSuffix(name, ".conf.json"):
+		return path.Join(dir, strings.TrimSuffix(name, ".conf.json"))
+	}
+	return path.Clean(fpath)
+}
+
+// isNodePath reports whether fpath is a node, i.e. it's the root or none
+// of its path elements below the root is a reserved name.
+func isNodePath(fpath string) bool {
+	rel, err := filepath.Rel(_rootDir, fpath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	if rel == "." {
+		return true
+	}
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		if isReservedName(elem) {
+			return false
+		}
+	}
+	return true
+}
+
+// update reindexes the nodes stored in the changed and removed files.
+func (idx *searchIndex) update(changed, removed []string) {
+	keys := make(map[string]struct{})
+	for _, f := range append(changed, removed...) {
+		if key := nodePathForFile(f); isNodePath(key) {
+			keys[key] = struct{}{}
+		}
+	}
+	var docs []*searchDoc
+	var gone []string
+	for key := range keys {
+		if !fileExists(key) {
+			gone = append(gone, key)
+			continue
+		}
+		if key == path.Clean(_rootDir) {
+			docs = append(docs, newSearchDoc(getRootNode()))
+			continue
+		}
+		n, err := newNodeFromPath(key)
+		if err != nil {
+			log.E(err)
+			gone = append(gone, key)
+			continue
+		}
+		docs = append(docs, newSearchDoc(n))
+	}
+	idx.Lock()
+	defer idx.Unlock()
+	for _, key := range gone {
+		idx.remove(key)
+	}
+	for _, doc := range docs {
+		idx.add(doc)
+	}
+}
+
+// search returns the visible nodes containing every word of the query,
+// best first, scored with tf-idf.
+func (idx *searchIndex) search(q string, limit int) []searchResult {
+	terms := tokenize(q)
+	if len(terms) == 0 {
+		return nil
+	}
+	idx.RLock()
+	var results []searchResult
+	total := float64(len(idx.docs))
+	for key := range idx.postings[terms[0]] {
+		doc := idx.docs[key]
+		score := 0.0
+		for _, t := range terms {
+			tf, ok := doc.terms[t]
+			if !ok {
+				score = 0
+				break
+			}
+			idf := math.Log(1 + total/float64(len(idx.postings[t])))
+			score += float64(tf) / math.Sqrt(float64(doc.length)) * idf
+		}
+		if score > 0 {
+			results = append(results, searchResult{node: doc.node, score: score, snippet: snippet(doc.text, terms)})
+		}
+	}
+	idx.RUnlock()
+
+	site := getSiteIndex()
+	results = filterResults(results, func(r searchResult) bool { return site.isVisible(r.node) })
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].node.title < results[j].node.title
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+func filterResults(rs []searchResult, f func(searchResult) bool) []searchResult {
+	var filtered []searchResult
+	for _, r := range rs {
+		if f(r) {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered
+}
+
+// snippet returns the text around the first match of one of the terms.
+func snippet(text string, terms []string) string {
+	pos := -1
+	for _, t := range terms {
+		if i := foldIndex(text, t); i >= 0 && (pos < 0 || i < pos) {
+			pos = i
+		}
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	runes := []rune(text)
+	// pos is a byte offset, move it to a rune offset
+	start := len([]rune(text[:min(pos, len(text))])) - snippetRadius
+	if start < 0 {
+		start = 0
+	}
+	end := start + 2*snippetRadius
+	if end > len(runes) {
+		end = len(runes)
+	}
+	s := string(runes[start:end])
+	if start > 0 {
+		s = "…" + s
+	}
+	if end < len(runes) {
+		s += "…"
+	}
+	return s
+}
+
+// foldPrefix returns the length in s of its prefix matching the lower-cased
+// term t, 0 if there's none. Lower-casing can change the length of a rune,
+// so s itself is matched rune by rune.
+func foldPrefix(s, t string) int {
+	i := 0
+	for _, tr := range t {
+		if i >= len(s) {
+			return 0
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if unicode.ToLower(r) != tr {
+			return 0
+		}
+		i += size
+	}
+	return i
+}
+
+// foldIndex returns the offset of the first match of the lower-cased term t
+// in s, or -1.
+func foldIndex(s, t string) int {
+	for i := range s {
+		if foldPrefix(s[i:], t) > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// highlightTerms escapes s and wraps the query terms in <b>.
+func highlightTerms(s string, terms []string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); {
+		matched := 0
+		for _, t := range terms {
+			if n := foldPrefix(s[i:], t); n > matched {
+				matched = n
+			}
+		}
+		if matched > 0 {
+			buf.WriteString("<b>" + html.EscapeString(s[i:i+matched]) + "</b>")
+			i += matched
+			continue
+		}
+		// copy up to the next position where a term could start
+		j := i + 1
+		for j < len(s) && !utf8Start(s[j]) {
+			j++
+		}
+		buf.WriteString(html.EscapeString(s[i:j]))
+		i = j
+	}
+	return buf.String()
+}
+
+func utf8Start(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+func searchPage(r *http.Request) *page {
+	p := pageFromNode(getRootNode())
+	p.Title = "Search"
+	q := r.URL.Query().Get("q")
+	p.bodyRender = func(p *page, ctx context.Context) ([]byte, error) {
+		var buf bytes.Buffer
+		buf.WriteString("<h1> Search </h1>")
+		buf.WriteString(`<form action="` + searchPath + `" method="get" class="search">`)
+		buf.WriteString(`<input type="search" name="q" value="` + html.EscapeString(q) + `" autofocus> <button type="submit">search</button></form>`)
+		if strings.TrimSpace(q) == "" {
+			return buf.Bytes(), nil
+		}
+		results := getSearchIndex().search(q, searchLimit)
+		if len(results) == 0 {
+			buf.WriteString("<p>No results.</p>")
+			return buf.Bytes(), nil
+		}
+		terms := tokenize(q)
+		buf.WriteString("<ul class=\"search-results\">")
+		for _, res := range results {
+			buf.WriteString("<li><a href=\"" + res.node.href() + "\">" + res.node.title + "</a> " + res.node.desc)
+			if res.snippet != "" {
+				buf.WriteString("<br><small>" + highlightTerms(res.snippet, terms) + "</small>")
+			}
+			buf.WriteString("</li>")
+		}
+		buf.WriteString("</ul>")
+		return buf.Bytes(), nil
+	}
+	return p
+}
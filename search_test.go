@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHighlightTerms(t *testing.T) {
+	for _, tt := range []struct {
+		s     string
+		terms []string
+		want  string
+	}{
+		{"Hello World", []string{"world"}, "Hello <b>World</b>"},
+		{"a <b> & c", []string{"c"}, "a &lt;b&gt; &amp; <b>c</b>"},
+		{"go gopher", []string{"go", "gopher"}, "<b>go</b> <b>gopher</b>"},
+		// the Kelvin sign is 3 bytes long, its lower case k is 1
+		{"\u212Aelvin temperature kelvin", []string{"kelvin"}, "<b>\u212Aelvin</b> temperature <b>kelvin</b>"},
+		{"ΣΟΦΙΑ und Straße", []string{"σοφια", "straße"}, "<b>ΣΟΦΙΑ</b> und <b>Straße</b>"},
+		{"İstanbul", []string{"istanbul"}, "<b>İstanbul</b>"},
+	} {
+		if got := highlightTerms(tt.s, tt.terms); got != tt.want {
+			t.Errorf("highlightTerms(%q, %q) = %q, want %q", tt.s, tt.terms, got, tt.want)
+		}
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	text := strings.Repeat("\u212A", 200) + " needle " + strings.Repeat("x", 200)
+	got := snippet(text, []string{"needle"})
+	if !strings.Contains(got, "needle") {
+		t.Errorf("snippet %q doesn't contain the term", got)
+	}
+}
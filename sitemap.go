@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/c4pt0r/log"
+)
+
+const (
+	sitemapXMLPath = "/sitemap.xml"
+	robotsPath     = "/robots.txt"
+	// robotsName is the file in the root directory served instead of the
+	// generated robots.txt
+	robotsName = "robots.txt"
+)
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// lastMod returns the modification time of the node's content, for a
+// directory it's the one of its index page if it has one.
+func (n *node) lastMod() time.Time {
+	if n.isDir {
+		if idx, err := getIndexNodeForDir(n.filepath); err == nil && idx != nil {
+			return idx.modTime
+		}
+	}
+	return n.modTime
+}
+
+// serveSitemapXML writes the sitemaps.org sitemap of the visible nodes.
+func serveSitemapXML(w http.ResponseWriter, r *http.Request) {
+	base := siteBaseURL(r)
+	root := getRootNode()
+	set := sitemapURLSet{}
+	add := func(n *node) {
+		set.URLs = append(set.URLs, sitemapURL{
+			Loc:     base + n.href(),
+			LastMod: n.lastMod().Format(time.RFC3339),
+		})
+	}
+	idx := getSiteIndex()
+	if idx.isVisible(root) {
+		add(root)
+	}
+	walkNodes(root, func(n *node) {
+		if idx.isVisible(n) {
+			add(n)
+		}
+	})
+	out, err := xml.MarshalIndent(set, "", "  ")
+	if err != nil {
+		log.E(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
+
+// serveRobots serves robots.txt from the root directory, or a generated
+// one pointing to the sitemap.
+func serveRobots(w http.ResponseWriter, r *http.Request) {
+	if fpath := filepath.Join(_rootDir, robotsName); fileExists(fpath) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeFile(w, r, fpath)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "User-agent: *\nAllow: /\n\nSitemap: %s%s\n", siteBaseURL(r), sitemapXMLPath)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// tagsPath lists every tag, tagsPath/<tag> the pages with that tag.
+const tagsPath = "/_tags"
+
+// tagLink is a tag as given to templates.
+type tagLink struct {
+	Name  string
+	URL   string
+	Count int
+}
+
+// normalizeTag makes "Go " and "go" the same tag.
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+func tagURL(tag string) string {
+	return tagsPath + "/" + url.PathEscape(tag)
+}
+
+// normalizeTags returns the distinct non-empty tags, in order.
+func normalizeTags(tags []string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, t := range tags {
+		if t = normalizeTag(t); t != "" && !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// tagged returns the visible nodes with the tag, in sitemap order.
+func (idx *siteIndex) tagged(tag string) []*node {
+	if idx == nil {
+		return nil
+	}
+	return filterNode(idx.tags[normalizeTag(tag)], idx.isVisible)
+}
+
+// tagCount returns the number of visible nodes with the tag.
+func (idx *siteIndex) tagCount(tag string) int {
+	return len(idx.tagged(tag))
+}
+
+// allTags returns the tags of the visible nodes with their counts, by name.
+func (idx *siteIndex) allTags() []tagLink {
+	if idx == nil {
+		return nil
+	}
+	var tags []tagLink
+	for tag := range idx.tags {
+		if count := idx.tagCount(tag); count > 0 {
+			tags = append(tags, tagLink{Name: tag, URL: tagURL(tag), Count: count})
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags
+}
+
+// tagLinks returns the tags of n with their counts.
+func (idx *siteIndex) tagLinks(n *node) []tagLink {
+	var tags []tagLink
+	for _, tag := range n.tags {
+		tags = append(tags, tagLink{Name: tag, URL: tagURL(tag), Count: idx.tagCount(tag)})
+	}
+	return tags
+}
+
+// AllTags returns every tag of the site, for templates.
+func (p *page) AllTags() []tagLink {
+	return getSiteIndex().allTags()
+}
+
+// tagsPage lists every tag at /_tags/, or the pages with a tag at
+// /_tags/<tag>.
+func tagsPage(r *http.Request) *page {
+	tag := strings.Trim(strings.TrimPrefix(r.URL.Path, tagsPath), "/")
+	p := pageFromNode(getRootNode())
+	p.Title = "Tags"
+	if tag != "" {
+		p.Title = "Tag: " + html.EscapeString(tag)
+	}
+	p.bodyRender = func(p *page, ctx context.Context) ([]byte, error) {
+		var buf bytes.Buffer
+		idx := getSiteIndex()
+		if tag == "" {
+			buf.WriteString("<h1> Tags </h1>")
+			tags := idx.allTags()
+			if len(tags) == 0 {
+				buf.WriteString("<p>No tags.</p>")
+				return buf.Bytes(), nil
+			}
+			buf.WriteString("<ul class=\"tags\">")
+			for _, t := range tags {
+				buf.WriteString("<li><a href=\"" + t.URL + "\">" + html.EscapeString(t.Name) + "</a> (" + strconv.Itoa(t.Count) + ")</li>")
+			}
+			buf.WriteString("</ul>")
+			return buf.Bytes(), nil
+		}
+		buf.WriteString("<h1> Tag: " + html.EscapeString(tag) + " </h1>")
+		nodes := idx.tagged(tag)
+		if len(nodes) == 0 {
+			buf.WriteString("<p>No pages with this tag.</p>")
+			return buf.Bytes(), nil
+		}
+		buf.WriteString("<ul>")
+		for _, n := range nodes {
+			buf.WriteString("<li><a href=\"" + n.href() + "\">" + n.title + "</a> " + n.desc + "</li>")
+		}
+		buf.WriteString("</ul>")
+		buf.WriteString("<p><a href=\"" + tagsPath + "/\">All tags</a></p>")
+		return buf.Bytes(), nil
+	}
+	return p
+}
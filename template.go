@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+const (
+	// dirTemplateName is the per-directory page template, it applies to the
+	// whole subtree unless a deeper directory has its own.
+	dirTemplateName = "_template.html"
+	// layoutsDir holds the named layouts referenced by the "layout" field in
+	// .conf.json, it lives in the root directory.
+	layoutsDir = "_layouts"
+)
+
+// partialNames are the blocks of the page template that can be replaced
+// one by one with a _<name>.html file in a directory.
+var partialNames = []string{"header", "nav", "footer"}
+
+// templateDirs returns the directories to look for templates in for a node,
+// nearest first, ending with the root directory.
+func templateDirs(n *node) []string {
+	dir := n.filepath
+	if !n.isDir {
+		dir = path.Dir(dir)
+	}
+	root := path.Clean(_rootDir)
+	var dirs []string
+	for {
+		dirs = append(dirs, dir)
+		if path.Clean(dir) == root || dir == "." || dir == "/" {
+			break
+		}
+		dir = path.Dir(dir)
+	}
+	return dirs
+}
+
+var (
+	_tplCacheMu sync.Mutex
+	// _tplCache holds the page templates parsed so far, by the files they
+	// are made of
+	_tplCache = make(map[string]*template.Template)
+)
+
+// clearTemplateCache forgets the parsed page templates, the tree or the
+// global template changed.
+func clearTemplateCache() {
+	_tplCacheMu.Lock()
+	defer _tplCacheMu.Unlock()
+	_tplCache = make(map[string]*template.Template)
+}
+
+// validateLayout checks that a layout is the name of a file in _layouts,
+// not a path.
+func validateLayout(name string) error {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid layout: %q", name)
+	}
+	return nil
+}
+
+func layoutPath(name string) (string, error) {
+	if err := validateLayout(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(_rootDir, layoutsDir, name+".html"), nil
+}
+
+// findBaseTemplate returns the file of the nearest page template for the
+// node: a layout set on the node or one of its parents, or a _template.html
+// in one of its directories, "" for the global template.
+func findBaseTemplate(n *node, dirs []string) (string, error) {
+	if n.layout != "" {
+		return layoutPath(n.layout)
+	}
+	for _, dir := range dirs {
+		if dir != n.filepath {
+			dn, err := newNodeFromPath(dir)
+			if err != nil {
+				return "", err
+			}
+			if dn.layout != "" {
+				return layoutPath(dn.layout)
+			}
+		}
+		if fpath := path.Join(dir, dirTemplateName); fileExists(fpath) {
+			return fpath, nil
+		}
+	}
+	return "", nil
+}
+
+func readTemplateFile(fpath string) (string, error) {
+	b, err := os.ReadFile(fpath)
+	if err != nil {
+		return "", fmt.Errorf("read template: %w", err)
+	}
+	return string(b), nil
+}
+
+// loadPageTemplate returns the template used to render the page of a node,
+// parsed once for the files it's made of.
+func loadPageTemplate(n *node) (*template.Template, error) {
+	dirs := templateDirs(n)
+	base, err := findBaseTemplate(n, dirs)
+	if err != nil {
+		return nil, err
+	}
+	// the nearest _<name>.html of each partial
+	partials := make(map[string]string)
+	key := base
+	for _, name := range partialNames {
+		for _, dir := range dirs {
+			if fpath := path.Join(dir, "_"+name+".html"); fileExists(fpath) {
+				partials[name] = fpath
+				key += "\x00" + fpath
+				break
+			}
+		}
+	}
+
+	_tplCacheMu.Lock()
+	tpl, ok := _tplCache[key]
+	_tplCacheMu.Unlock()
+	if ok {
+		return tpl, nil
+	}
+	if tpl, err = parsePageTemplate(base, partials); err != nil {
+		return nil, err
+	}
+	_tplCacheMu.Lock()
+	_tplCache[key] = tpl
+	_tplCacheMu.Unlock()
+	return tpl, nil
+}
+
+// parsePageTemplate parses the base template file, the global template for
+// "", and overrides the named partials with theirs.
+func parsePageTemplate(base string, partials map[string]string) (*template.Template, error) {
+	src := getGlobalTemplate()
+	if base != "" {
+		var err error
+		if src, err = readTemplateFile(base); err != nil {
+			return nil, err
+		}
+	}
+	tpl := template.New("page")
+	if _, err := tpl.New("toc").Parse(tocTpl); err != nil {
+		return nil, err
+	}
+	if _, err := tpl.Parse(src); err != nil {
+		return nil, err
+	}
+	for _, name := range partialNames {
+		fpath, ok := partials[name]
+		if !ok {
+			continue
+		}
+		partial, err := readTemplateFile(fpath)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tpl.New(name).Parse(partial); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", fpath, err)
+		}
+	}
+	return tpl, nil
+}
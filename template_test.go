@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLayoutNames(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "../../x", "a/b", `a\b`, "/etc/x"} {
+		if err := validateLayout(name); err == nil {
+			t.Errorf("layout %q accepted", name)
+		}
+	}
+	if err := validateLayout("post"); err != nil {
+		t.Error(err)
+	}
+	if err := (&nodeConf{Layout: "../x"}).validate(); err == nil {
+		t.Error("conf with a layout path validated")
+	}
+}
+
+func TestPageTemplateCache(t *testing.T) {
+	root := newTestSite(t, defaultSiteConfig(), map[string]string{
+		"_layouts/post.html": "post {{ .Title }}",
+		"a.md":               "# A\n",
+		"a.md.conf.json":     `{"layout": "post"}`,
+		"b.md":               "# B\n",
+		"b.md.conf.json":     `{"layout": "../../x"}`,
+	})
+	if _, err := newNodeFromPath(filepath.Join(root, "b.md")); err == nil {
+		t.Error("node with a layout path loaded")
+	}
+
+	n, err := newNodeFromPath(filepath.Join(root, "a.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl, err := loadPageTemplate(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := loadPageTemplate(n); again != tpl {
+		t.Error("template parsed again")
+	}
+	if err := os.WriteFile(filepath.Join(root, "_layouts/post.html"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	clearTemplateCache()
+	if again, _ := loadPageTemplate(n); again == tpl {
+		t.Error("template kept after the cache was cleared")
+	}
+}
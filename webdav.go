@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/c4pt0r/log"
+	"golang.org/x/net/webdav"
+)
+
+const defaultWebDAVPrefix = "/_dav/"
+
+// webdavConfig is the "webdav" section of the site config.
+type webdavConfig struct {
+	// Enabled serves the root directory over WebDAV
+	Enabled bool `json:"enabled"`
+	// Prefix is the URL the tree is mounted at, default /_dav/
+	Prefix string `json:"prefix"`
+}
+
+func (c *webdavConfig) prefix() string {
+	if c.Prefix == "" {
+		return defaultWebDAVPrefix
+	}
+	return "/" + strings.Trim(c.Prefix, "/") + "/"
+}
+
+// davFS is the root directory with the rules of the web handler: protected
+// files are invisible and nodes protected by auth need it.
+type davFS struct {
+	dir webdav.Dir
+}
+
+// check returns the file of name if the request in ctx may access it.
+func (d davFS) check(ctx context.Context, name string) (string, error) {
+	fpath, err := resolveNodePath(name)
+	if err != nil {
+		return "", os.ErrNotExist
+	}
+	r, _ := ctx.Value("request").(*http.Request)
+	if r == nil || !nodeAccessAllowed(r, fpath) {
+		return "", os.ErrPermission
+	}
+	return fpath, nil
+}
+
+func (d davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if _, err := d.check(ctx, name); err != nil {
+		return err
+	}
+	return d.dir.Mkdir(ctx, name, perm)
+}
+
+func (d davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if _, err := d.check(ctx, name); err != nil {
+		return nil, err
+	}
+	f, err := d.dir.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return davFile{File: f, ctx: ctx, name: name}, nil
+}
+
+func (d davFS) RemoveAll(ctx context.Context, name string) error {
+	fpath, err := d.check(ctx, name)
+	if err != nil {
+		return err
+	}
+	if fpath == filepath.Clean(_rootDir) {
+		return os.ErrPermission
+	}
+	return d.dir.RemoveAll(ctx, name)
+}
+
+// Rename moves the .conf.json of a file along with it, the one of a
+// directory is in it. A file moved over another one doesn't get its conf.
+func (d davFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldPath, err := d.check(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := d.check(ctx, newName)
+	if err != nil {
+		return err
+	}
+	if err := d.dir.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	if info, err := os.Stat(newPath); err != nil || info.IsDir() {
+		return err
+	}
+	oldConf, newConf := oldPath+".conf.json", newPath+".conf.json"
+	if fileExists(oldConf) {
+		return os.Rename(oldConf, newConf)
+	}
+	if err := os.Remove(newConf); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if _, err := d.check(ctx, name); err != nil {
+		return nil, err
+	}
+	return d.dir.Stat(ctx, name)
+}
+
+// davFile hides the protected and inaccessible entries of directories.
+type davFile struct {
+	webdav.File
+	ctx  context.Context
+	name string
+}
+
+func (f davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	var visible []fs.FileInfo
+	for _, info := range infos {
+		if _, err := (davFS{}).check(f.ctx, path.Join(f.name, info.Name())); err == nil {
+			visible = append(visible, info)
+		}
+	}
+	return visible, err
+}
+
+// nodeAccessAllowed reports whether the request passes the auth_token and
+// basic_auth of the node at fpath and its parents, the closest existing
+// one for a new file.
+func nodeAccessAllowed(r *http.Request, fpath string) bool {
+	for !fileExists(fpath) && fpath != filepath.Clean(_rootDir) {
+		fpath = filepath.Dir(fpath)
+	}
+	n, err := newNodeFromPath(fpath)
+	if err != nil {
+		log.E(err)
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	for cur := n; cur != nil; cur, _ = cur.getParentNode() {
+		if cur.authToken != "" && auth != "Bearer "+cur.authToken {
+			return false
+		}
+		if cur.basicAuth.username != "" && cur.basicAuth.password != "" &&
+			!checkBasicAuth(auth, cur.basicAuth.username, cur.basicAuth.password) {
+			return false
+		}
+	}
+	return true
+}
+
+// isDAVWrite reports whether the WebDAV method changes the tree.
+func isDAVWrite(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PROPFIND":
+		return false
+	}
+	return true
+}
+
+// statusRecorder keeps the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// newWebDAVHandler serves the root directory under prefix. Reads need the
+// site auth when it's required, writes a user with write permission. They
+// are committed when history is enabled and update the site and search
+// indexes right away.
+func newWebDAVHandler(prefix string) http.Handler {
+	dav := &webdav.Handler{
+		Prefix:     strings.TrimSuffix(prefix, "/"),
+		FileSystem: davFS{dir: webdav.Dir(_rootDir)},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !os.IsNotExist(err) {
+				log.E(r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Infof("%s %s %s", r.RemoteAddr, r.Method, r.URL)
+		user := ""
+		if isDAVWrite(r.Method) {
+			var ok bool
+			if user, ok = checkWrite(w, r); !ok {
+				return
+			}
+		} else if !checkSiteAuth(w, r) {
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		dav.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), "request", r)))
+		if !isDAVWrite(r.Method) || rec.status >= 400 || r.Method == "LOCK" || r.Method == "UNLOCK" {
+			return
+		}
+
+		files := []string{davFilePath(prefix, r.URL.Path)}
+		if dst := r.Header.Get("Destination"); dst != "" {
+			if u, err := url.Parse(dst); err == nil {
+				files = append(files, davFilePath(prefix, u.Path))
+			}
+		}
+		if r.Method == "MOVE" {
+			// the .conf.json of a file moves with it
+			for _, f := range files {
+				files = append(files, f+".conf.json")
+			}
+		}
+		if err := commitFiles(user, fmt.Sprintf("WebDAV %s %s", r.Method, strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(prefix, "/"))), files...); err != nil {
+			log.E(err)
+		}
+		invalidateTree(files...)
+	})
+}
+
+// davFilePath returns the file of a WebDAV URL path.
+func davFilePath(prefix, urlPath string) string {
+	return filepath.Join(_rootDir, filepath.FromSlash(path.Clean("/"+strings.TrimPrefix(urlPath, strings.TrimSuffix(prefix, "/")))))
+}
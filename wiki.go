@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"html"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// brokenLinksPath is the report of wiki links pointing nowhere, broken
+// links point to it.
+const brokenLinksPath = "/_broken-links"
+
+// pageLink is a link to a node, as given to templates.
+type pageLink struct {
+	Title string
+	URL   string
+}
+
+func linkTo(n *node) pageLink {
+	return pageLink{Title: n.title, URL: n.href()}
+}
+
+// href returns the URL to link to the node, directories get a trailing slash.
+func (n *node) href() string {
+	u := n.URL()
+	if n.isDir && u != "/" {
+		u += "/"
+	}
+	return u
+}
+
+// resolveWikiLink finds the node a [[target]] written in from points to:
+// a path relative to the page's directory, then to the root, then a title.
+func (idx *siteIndex) resolveWikiLink(from *node, target string) *node {
+	if idx == nil {
+		return nil
+	}
+	target = strings.TrimSpace(target)
+	if target == "" {
+		return nil
+	}
+	var bases []string
+	if !strings.HasPrefix(target, "/") && from != nil {
+		dir := from.filepath
+		if !from.isDir {
+			dir = path.Dir(dir)
+		}
+		bases = append(bases, dir)
+	}
+	bases = append(bases, _rootDir)
+	for _, base := range bases {
+		p := path.Join(base, target)
+		for _, candidate := range []string{p, p + ".md", strings.ReplaceAll(p, " ", "_") + ".md"} {
+			if n := idx.lookup(candidate); n != nil {
+				return n
+			}
+		}
+	}
+	return idx.byTitle[strings.ToLower(target)]
+}
+
+// registerWikiLinks makes p turn [[target]] and [[target|label]] into
+// links, resolved against idx from the page from. found is called for
+// every wiki link, to with nil for broken ones.
+func registerWikiLinks(p *parser.Parser, idx *siteIndex, from *node, found func(target string, to *node)) {
+	var prev parser.InlineParser
+	prev = p.RegisterInline('[', func(p *parser.Parser, data []byte, offset int) (int, ast.Node) {
+		rest := data[offset:]
+		if !bytes.HasPrefix(rest, []byte("[[")) {
+			return prev(p, data, offset)
+		}
+		end := bytes.Index(rest, []byte("]]"))
+		if end < 0 || bytes.ContainsAny(rest[2:end], "[\n") {
+			return prev(p, data, offset)
+		}
+		target, label, ok := strings.Cut(string(rest[2:end]), "|")
+		if !ok {
+			label = target
+		}
+		target = strings.TrimSpace(target)
+		to := idx.resolveWikiLink(from, target)
+		if found != nil {
+			found(target, to)
+		}
+		link := &ast.Link{}
+		if to != nil {
+			link.Destination = []byte(to.href())
+			link.AdditionalAttributes = []string{`class="wikilink"`}
+		} else {
+			link.Destination = []byte(brokenLinksPath)
+			link.AdditionalAttributes = []string{`class="wikilink broken"`}
+		}
+		ast.AppendChild(link, &ast.Text{Leaf: ast.Leaf{Literal: []byte(strings.TrimSpace(label))}})
+		return end + 2, link
+	})
+}
+
+// indexLinks records the wiki links of a node as backlinks or broken links.
+func (idx *siteIndex) indexLinks(n *node) {
+	content, ok := readMarkdownSource(n)
+	if !ok {
+		return
+	}
+	p := defaultMarkdownOptions().newParser()
+	seen := make(map[string]bool)
+	registerWikiLinks(p, idx, n, func(target string, to *node) {
+		if to == nil {
+			idx.broken = append(idx.broken, brokenLink{from: n, target: target})
+			return
+		}
+		key := path.Clean(to.filepath)
+		if seen[key] || to.filepath == n.filepath {
+			return
+		}
+		seen[key] = true
+		idx.backlinks[key] = append(idx.backlinks[key], n)
+	})
+	p.Parse(content)
+}
+
+// backlinksOf returns links to the visible pages linking to n.
+func (idx *siteIndex) backlinksOf(n *node) []pageLink {
+	if idx == nil {
+		return nil
+	}
+	var links []pageLink
+	for _, from := range idx.backlinks[path.Clean(n.filepath)] {
+		if idx.isVisible(from) {
+			links = append(links, linkTo(from))
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Title < links[j].Title })
+	return links
+}
+
+func brokenLinksPage() *page {
+	p := pageFromNode(getRootNode())
+	p.Title = "Broken links"
+	p.bodyRender = func(p *page, ctx context.Context) ([]byte, error) {
+		var buf bytes.Buffer
+		buf.WriteString("<h1> Broken links </h1>")
+		idx := getSiteIndex()
+		if idx == nil || len(idx.broken) == 0 {
+			buf.WriteString("<p>No broken links.</p>")
+			return buf.Bytes(), nil
+		}
+		buf.WriteString("<ul>")
+		for _, bl := range idx.broken {
+			if !idx.isVisible(bl.from) {
+				continue
+			}
+			buf.WriteString("<li><a href=\"" + bl.from.href() + "\">" + bl.from.title + "</a>: ")
+			buf.WriteString("<span class=\"wikilink broken\">[[" + html.EscapeString(bl.target) + "]]</span></li>")
+		}
+		buf.WriteString("</ul>")
+		return buf.Bytes(), nil
+	}
+	return p
+}